@@ -22,6 +22,8 @@ var server_id = flag.Int("server_id", 0, "MySQL server id, as a pseudo slave")
 var flavor = flag.String("flavor", "", "flavor: mysql or mariadb")
 var execution = flag.String("exec", "", "mysqldump execution path")
 var logLevel = flag.String("log_level", "info", "log level")
+var replayDeadLetter = flag.Bool("replay_dead_letter", false, "replay the dead letters in data_dir then exit, the river must be stopped")
+var checkMapping = flag.Bool("check_mapping", false, "check whether the synced columns are compatible with the Elasticsearch mapping then exit")
 
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
@@ -76,6 +78,30 @@ func main() {
 		cfg.DumpExec = *execution
 	}
 
+	if *replayDeadLetter {
+		if err = river.ReplayDeadLetter(cfg); err != nil {
+			println(errors.ErrorStack(err))
+		}
+		return
+	}
+
+	if *checkMapping {
+		conflicts, err := river.CheckMapping(cfg)
+		if err != nil {
+			println(errors.ErrorStack(err))
+			os.Exit(1)
+		}
+
+		for _, c := range conflicts {
+			println(c.String())
+		}
+		if len(conflicts) > 0 {
+			os.Exit(1)
+		}
+		println("mapping check OK")
+		return
+	}
+
 	r, err := river.NewRiver(cfg)
 	if err != nil {
 		println(errors.ErrorStack(err))
@@ -8,6 +8,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/juju/errors"
 )
@@ -21,7 +25,25 @@ type Client struct {
 	User     string
 	Password string
 
+	// APIKey is the base64 encoded ES API key, it is preferred to BearerToken and basic auth.
+	APIKey string
+	// BearerToken is used if the ES is behind a gateway expecting a bearer token.
+	BearerToken string
+	// Headers are the custom headers added to every request.
+	Headers map[string]string
+
+	// BulkMaxBytes is the max payload size of one bulk request, 0 means no limit.
+	BulkMaxBytes int
+
+	// Version is the ES server version, like 6.8.0.
+	// Since 7.0, we use the typeless APIs, and the document type is ignored.
+	Version string
+
 	c *http.Client
+
+	// nodes is nil if only one node.
+	nodes   *nodePool
+	closeCh chan struct{}
 }
 
 // ClientConfig is the configuration for the client.
@@ -30,20 +52,53 @@ type ClientConfig struct {
 	Addr     string
 	User     string
 	Password string
+	// If not set, use DetectVersion to get it from the server.
+	Version string
+
+	// Addrs is the ES nodes, the requests are sent to them in round-robin, Addr is ignored if set.
+	Addrs []string
+	// HealthCheckInterval is the interval to probe the dead nodes, default 10s.
+	HealthCheckInterval time.Duration
+
+	APIKey      string
+	BearerToken string
+	Headers     map[string]string
+
+	// BulkMaxBytes splits the bulk request into multiple requests under the size,
+	// it should not be larger than http.max_content_length of ES.
+	BulkMaxBytes int
+
+	// TLSConfig is used if HTTPS is true, the server certificate is verified with
+	// the system roots if nil. See NewTLSConfig.
+	TLSConfig *tls.Config
 }
 
 // NewClient creates the Cient with configuration.
 func NewClient(conf *ClientConfig) *Client {
 	c := new(Client)
 
-	c.Addr = conf.Addr
+	addrs := conf.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{conf.Addr}
+	}
+
+	c.Addr = addrs[0]
 	c.User = conf.User
 	c.Password = conf.Password
+	c.APIKey = conf.APIKey
+	c.BearerToken = conf.BearerToken
+	c.Headers = conf.Headers
+	c.Version = conf.Version
+	c.BulkMaxBytes = conf.BulkMaxBytes
 
 	if conf.HTTPS {
 		c.Protocol = "https"
+		tlsConfig := conf.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = new(tls.Config)
+		}
 		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			TLSClientConfig: tlsConfig,
 		}
 		c.c = &http.Client{Transport: tr}
 	} else {
@@ -51,9 +106,29 @@ func NewClient(conf *ClientConfig) *Client {
 		c.c = &http.Client{}
 	}
 
+	c.closeCh = make(chan struct{})
+	if len(addrs) > 1 {
+		c.nodes = newNodePool(addrs)
+
+		interval := conf.HealthCheckInterval
+		if interval == 0 {
+			interval = defaultHealthCheckInterval
+		}
+		go c.healthCheck(interval)
+	}
+
 	return c
 }
 
+// Close stops the health checker of the nodes.
+func (c *Client) Close() {
+	select {
+	case <-c.closeCh:
+	default:
+		close(c.closeCh)
+	}
+}
+
 // ResponseItem is the ES item in the response.
 type ResponseItem struct {
 	ID      string                 `json:"_id"`
@@ -76,27 +151,48 @@ const (
 	ActionUpdate = "update"
 	ActionDelete = "delete"
 	ActionIndex  = "index"
+
+	// VersionTypeExternal writes the doc only if the version is greater than the existing one.
+	VersionTypeExternal = "external"
 )
 
 // BulkRequest is used to send multi request in batch.
 type BulkRequest struct {
-	Action   string
-	Index    string
-	Type     string
-	ID       string
-	Parent   string
-	Pipeline string
-
-	Data map[string]interface{}
+	Action   string `json:"action"`
+	Index    string `json:"index"`
+	Type     string `json:"type,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Parent   string `json:"parent,omitempty"`
+	Pipeline string `json:"pipeline,omitempty"`
+
+	Data map[string]interface{} `json:"data,omitempty"`
+
+	// For the update action, the doc is updated by Script instead of Data if set.
+	// Upsert is the doc to index if the doc doesn't exist, and if ScriptedUpsert
+	// is true, the script runs on it. DocAsUpsert indexes Data if the doc doesn't exist.
+	Script         map[string]interface{} `json:"script,omitempty"`
+	Upsert         map[string]interface{} `json:"upsert,omitempty"`
+	ScriptedUpsert bool                   `json:"scripted_upsert,omitempty"`
+	DocAsUpsert    bool                   `json:"doc_as_upsert,omitempty"`
+
+	// If VersionType is external, the doc is written only if Version is greater than
+	// the version of the existing doc, it can't be used for the update action.
+	Version     int64  `json:"version,omitempty"`
+	VersionType string `json:"version_type,omitempty"`
+
+	// BinName and BinPos are the binlog position of the change, they are not sent to ES
+	// but kept to track the request, e.g, in the dead letter queue.
+	BinName string `json:"bin_name,omitempty"`
+	BinPos  uint32 `json:"bin_pos,omitempty"`
 }
 
-func (r *BulkRequest) bulk(buf *bytes.Buffer) error {
-	meta := make(map[string]map[string]string)
-	metaData := make(map[string]string)
+func (r *BulkRequest) bulk(buf *bytes.Buffer, typeless bool) error {
+	meta := make(map[string]map[string]interface{})
+	metaData := make(map[string]interface{})
 	if len(r.Index) > 0 {
 		metaData["_index"] = r.Index
 	}
-	if len(r.Type) > 0 {
+	if len(r.Type) > 0 && !typeless {
 		metaData["_type"] = r.Type
 	}
 
@@ -104,11 +200,20 @@ func (r *BulkRequest) bulk(buf *bytes.Buffer) error {
 		metaData["_id"] = r.ID
 	}
 	if len(r.Parent) > 0 {
-		metaData["_parent"] = r.Parent
+		if typeless {
+			// _parent is removed, the child must be routed to the shard of its parent.
+			metaData["routing"] = r.Parent
+		} else {
+			metaData["_parent"] = r.Parent
+		}
 	}
 	if len(r.Pipeline) > 0 {
 		metaData["pipeline"] = r.Pipeline
 	}
+	if len(r.VersionType) > 0 {
+		metaData["version"] = r.Version
+		metaData["version_type"] = r.VersionType
+	}
 
 	meta[r.Action] = metaData
 
@@ -124,8 +229,24 @@ func (r *BulkRequest) bulk(buf *bytes.Buffer) error {
 	case ActionDelete:
 		//nothing to do
 	case ActionUpdate:
-		doc := map[string]interface{}{
-			"doc": r.Data,
+		doc := make(map[string]interface{}, 3)
+		if r.Script != nil {
+			doc["script"] = r.Script
+			if r.Upsert != nil {
+				doc["upsert"] = r.Upsert
+			}
+			if r.ScriptedUpsert {
+				doc["scripted_upsert"] = true
+				if r.Upsert == nil {
+					// the script creates the doc from the empty one
+					doc["upsert"] = map[string]interface{}{}
+				}
+			}
+		} else {
+			doc["doc"] = r.Data
+			if r.DocAsUpsert {
+				doc["doc_as_upsert"] = true
+			}
 		}
 		data, err = json.Marshal(doc)
 		if err != nil {
@@ -175,28 +296,166 @@ type MappingResponse struct {
 }
 
 // Mapping represents ES mapping.
-type Mapping map[string]struct {
-	Mappings map[string]struct {
-		Properties map[string]struct {
-			Type   string      `json:"type"`
-			Fields interface{} `json:"fields"`
-		} `json:"properties"`
-	} `json:"mappings"`
+type Mapping map[string]IndexMapping
+
+// IndexMapping is the mapping of an index, grouped by document type.
+// For the typeless APIs, the type is the one used in GetMapping.
+type IndexMapping struct {
+	Mappings map[string]TypeMapping `json:"mappings"`
+}
+
+// TypeMapping is the mapping of a document type.
+type TypeMapping struct {
+	Properties map[string]FieldMapping `json:"properties"`
+}
+
+// FieldMapping is the mapping of a field.
+type FieldMapping struct {
+	Type   string      `json:"type"`
+	Fields interface{} `json:"fields"`
+	// Properties is the mapping of the sub fields for the object and nested field.
+	Properties map[string]FieldMapping `json:"properties"`
+}
+
+// typelessMapping is the mapping returned by the typeless API.
+type typelessMapping map[string]struct {
+	Mappings TypeMapping `json:"mappings"`
+}
+
+// DetectVersion gets the version from the ES server.
+func (c *Client) DetectVersion() error {
+	reqURL := fmt.Sprintf("%s://%s/", c.Protocol, c.Addr)
+
+	resp, err := c.DoRequest("GET", reqURL, bytes.NewBuffer(nil))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Error: %s, code: %d", http.StatusText(resp.StatusCode), resp.StatusCode)
+	}
+
+	var info struct {
+		Version struct {
+			Number string `json:"number"`
+		} `json:"version"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(info.Version.Number) == 0 {
+		return errors.Errorf("no version number in the response of %s", reqURL)
+	}
+
+	c.Version = info.Version.Number
+	return nil
+}
+
+// MajorVersion returns the major version of ES, or 0 if unknown.
+func (c *Client) MajorVersion() int {
+	v, _ := strconv.Atoi(strings.SplitN(c.Version, ".", 2)[0])
+	return v
+}
+
+// Typeless returns true if the document type is removed, since ES 7.0.
+func (c *Client) Typeless() bool {
+	return c.MajorVersion() >= 7
+}
+
+func (c *Client) docURL(index string, docType string, id string) string {
+	if c.Typeless() {
+		docType = "_doc"
+	}
+
+	return fmt.Sprintf("%s://%s/%s/%s/%s", c.Protocol, c.Addr,
+		url.QueryEscape(index),
+		url.QueryEscape(docType),
+		url.QueryEscape(id))
+}
+
+func (c *Client) mappingURL(index string, docType string) string {
+	if c.Typeless() {
+		return fmt.Sprintf("%s://%s/%s/_mapping", c.Protocol, c.Addr,
+			url.QueryEscape(index))
+	}
+
+	return fmt.Sprintf("%s://%s/%s/%s/_mapping", c.Protocol, c.Addr,
+		url.QueryEscape(index),
+		url.QueryEscape(docType))
+}
+
+// setAuth adds the custom headers and the authorization to the request.
+func (c *Client) setAuth(req *http.Request) {
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if len(c.APIKey) > 0 {
+		req.Header.Set("Authorization", "ApiKey "+c.APIKey)
+	} else if len(c.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	} else if len(c.User) > 0 && len(c.Password) > 0 {
+		req.SetBasicAuth(c.User, c.Password)
+	}
+}
+
+func (c *Client) newRequest(method string, reqURL string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	c.setAuth(req)
+	return req, nil
 }
 
 // DoRequest sends a request with body to ES.
-func (c *Client) DoRequest(method string, url string, body *bytes.Buffer) (*http.Response, error) {
-	req, err := http.NewRequest(method, url, body)
-	req.Header.Add("Content-Type", "application/json")
+// If the request is sent to one of the nodes, we will pick an alive node in turn instead,
+// and try the next one if we can't connect to it.
+func (c *Client) DoRequest(method string, reqURL string, body *bytes.Buffer) (*http.Response, error) {
+	var data []byte
+	if body != nil {
+		data = body.Bytes()
+	}
+
+	u, err := url.Parse(reqURL)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	if len(c.User) > 0 && len(c.Password) > 0 {
-		req.SetBasicAuth(c.User, c.Password)
+
+	if c.nodes == nil || !c.nodes.has(u.Host) {
+		req, err := c.newRequest(method, reqURL, data)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return c.c.Do(req)
+	}
+
+	for i := 0; i < len(c.nodes.nodes); i++ {
+		n := c.nodes.pick()
+		u.Host = n.addr
+
+		var req *http.Request
+		if req, err = c.newRequest(method, u.String(), data); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		var resp *http.Response
+		if resp, err = c.c.Do(req); err == nil {
+			return resp, nil
+		}
+
+		c.nodes.markDead(n, err)
+		if !isDialError(err) {
+			// the request may be handled, let the caller decide to retry or not.
+			break
+		}
 	}
-	resp, err := c.c.Do(req)
 
-	return resp, err
+	return nil, err
 }
 
 // Do sends the request with body to ES.
@@ -234,16 +493,145 @@ func (c *Client) Do(method string, url string, body map[string]interface{}) (*Re
 }
 
 // DoBulk sends the bulk request to the ES.
+// If BulkMaxBytes is set, the items are split into multiple requests under the size in order,
+// and the items in the responses are merged. The item which can never fit is not sent, and
+// its response item has status 413. If the first request fails, the response of it is returned,
+// otherwise the items not written yet fail with the status of the failed request, or 503 if it
+// can't be sent, so that only they need to be sent again.
 func (c *Client) DoBulk(url string, items []*BulkRequest) (*BulkResponse, error) {
-	var buf bytes.Buffer
+	if c.BulkMaxBytes <= 0 {
+		var buf bytes.Buffer
+		for _, item := range items {
+			if err := item.bulk(&buf, c.Typeless()); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		return c.doBulk(url, &buf)
+	}
+
+	chunks, err := c.splitBulk(items)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ret := &BulkResponse{Code: http.StatusOK}
+	written := false
+	for i, chunk := range chunks {
+		if chunk.tooLarge != nil {
+			ret.Errors = true
+			ret.Items = append(ret.Items, chunk.tooLarge)
+			continue
+		}
+
+		resp, err := c.doBulk(url, bytes.NewBuffer(chunk.data))
+		if err == nil && resp.Code/100 == 2 {
+			written = true
+			ret.Took += resp.Took
+			ret.Errors = ret.Errors || resp.Errors
+			ret.Items = append(ret.Items, resp.Items...)
+			continue
+		}
+
+		if !written {
+			// nothing is written, the whole bulk can be sent again
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			return resp, nil
+		}
+
+		status := http.StatusServiceUnavailable
+		var reason string
+		if err != nil {
+			reason = fmt.Sprintf("bulk request failed: %v", err)
+		} else {
+			status = resp.Code
+			reason = fmt.Sprintf("bulk request failed with status %d", resp.Code)
+		}
+
+		ret.Errors = true
+		for _, rest := range chunks[i:] {
+			if rest.tooLarge != nil {
+				ret.Items = append(ret.Items, rest.tooLarge)
+				continue
+			}
+			for _, item := range rest.items {
+				ret.Items = append(ret.Items, failedItem(item, status, "bulk_request_failed", reason))
+			}
+		}
+		return ret, nil
+	}
+
+	return ret, nil
+}
+
+// bulkChunk is the items sent in one bulk request.
+type bulkChunk struct {
+	items []*BulkRequest
+	data  []byte
+
+	// tooLarge is the response item of the item which can never fit, it is not sent.
+	tooLarge map[string]*BulkResponseItem
+}
+
+// splitBulk splits the items into chunks under BulkMaxBytes in order.
+func (c *Client) splitBulk(items []*BulkRequest) ([]*bulkChunk, error) {
+	var chunks []*bulkChunk
+	var cur *bulkChunk
+	var itemBuf bytes.Buffer
 
 	for _, item := range items {
-		if err := item.bulk(&buf); err != nil {
+		itemBuf.Reset()
+		if err := item.bulk(&itemBuf, c.Typeless()); err != nil {
 			return nil, errors.Trace(err)
 		}
+
+		if itemBuf.Len() > c.BulkMaxBytes {
+			// keep it in its own chunk, so the response items are in order
+			chunks = append(chunks, &bulkChunk{tooLarge: tooLargeItem(item, itemBuf.Len(), c.BulkMaxBytes)})
+			cur = nil
+			continue
+		}
+
+		if cur == nil || len(cur.data)+itemBuf.Len() > c.BulkMaxBytes {
+			cur = new(bulkChunk)
+			chunks = append(chunks, cur)
+		}
+
+		cur.data = append(cur.data, itemBuf.Bytes()...)
+		cur.items = append(cur.items, item)
 	}
 
-	resp, err := c.DoRequest("POST", url, &buf)
+	return chunks, nil
+}
+
+// tooLargeItem builds the response item for the request which is larger than the bulk size limit.
+func tooLargeItem(item *BulkRequest, size int, limit int) map[string]*BulkResponseItem {
+	reason := fmt.Sprintf("bulk item size %d exceeds the limit %d", size, limit)
+	return failedItem(item, http.StatusRequestEntityTooLarge, "document_too_large", reason)
+}
+
+// failedItem builds the response item for the request which is not written.
+func failedItem(item *BulkRequest, status int, errType string, reason string) map[string]*BulkResponseItem {
+	data, _ := json.Marshal(map[string]string{
+		"type":   errType,
+		"reason": reason,
+	})
+
+	return map[string]*BulkResponseItem{
+		item.Action: {
+			Index:  item.Index,
+			Type:   item.Type,
+			ID:     item.ID,
+			Status: status,
+			Error:  data,
+		},
+	}
+}
+
+func (c *Client) doBulk(url string, buf *bytes.Buffer) (*BulkResponse, error) {
+	resp, err := c.DoRequest("POST", url, buf)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -258,6 +646,12 @@ func (c *Client) DoBulk(url string, items []*BulkRequest) (*BulkResponse, error)
 		return nil, errors.Trace(err)
 	}
 
+	// the body of a failed request may not be JSON, e.g, an HTML page from the proxy,
+	// so return the status code only to let the caller handle it by the code.
+	if ret.Code/100 != 2 {
+		return ret, nil
+	}
+
 	if len(data) > 0 {
 		err = json.Unmarshal(data, &ret)
 	}
@@ -286,19 +680,30 @@ func (c *Client) CreateMapping(index string, docType string, mapping map[string]
 		return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
 	}
 
-	reqURL = fmt.Sprintf("%s://%s/%s/%s/_mapping", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType))
+	reqURL = c.mappingURL(index, docType)
+
+	if c.Typeless() {
+		// the mapping may be wrapped with the type name for the old versions
+		if m, ok := mapping[docType].(map[string]interface{}); ok {
+			mapping = m
+		}
+	}
 
-	_, err = c.Do("POST", reqURL, mapping)
-	return errors.Trace(err)
+	r, err = c.Do("POST", reqURL, mapping)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code != http.StatusOK {
+		return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+	}
+
+	return nil
 }
 
 // GetMapping gets the mapping.
 func (c *Client) GetMapping(index string, docType string) (*MappingResponse, error) {
-	reqURL := fmt.Sprintf("%s://%s/%s/%s/_mapping", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType))
+	reqURL := c.mappingURL(index, docType)
 	buf := bytes.NewBuffer(nil)
 	resp, err := c.DoRequest("GET", reqURL, buf)
 
@@ -314,13 +719,30 @@ func (c *Client) GetMapping(index string, docType string) (*MappingResponse, err
 	}
 
 	ret := new(MappingResponse)
-	err = json.Unmarshal(data, &ret.Mapping)
-	if err != nil {
+	ret.Code = resp.StatusCode
+	ret.Mapping = make(Mapping)
+
+	// the body is an error, e.g, the index doesn't exist
+	if ret.Code != http.StatusOK {
+		return ret, nil
+	}
+
+	if c.Typeless() {
+		var m typelessMapping
+		if err = json.Unmarshal(data, &m); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for name, im := range m {
+			ret.Mapping[name] = IndexMapping{
+				Mappings: map[string]TypeMapping{docType: im.Mappings},
+			}
+		}
+	} else if err = json.Unmarshal(data, &ret.Mapping); err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	ret.Code = resp.StatusCode
-	return ret, errors.Trace(err)
+	return ret, nil
 }
 
 // DeleteIndex deletes the index.
@@ -340,22 +762,167 @@ func (c *Client) DeleteIndex(index string) error {
 	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
 }
 
+// IndexExists checks whether the index or alias exists or not.
+func (c *Client) IndexExists(index string) (bool, error) {
+	reqURL := fmt.Sprintf("%s://%s/%s", c.Protocol, c.Addr,
+		url.QueryEscape(index))
+
+	r, err := c.Do("HEAD", reqURL, nil)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK || r.Code == http.StatusNotFound {
+		return r.Code == http.StatusOK, nil
+	}
+
+	return false, errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// CreateIndex creates the index with the settings and mappings in body, body can be nil.
+func (c *Client) CreateIndex(index string, body map[string]interface{}) error {
+	reqURL := fmt.Sprintf("%s://%s/%s", c.Protocol, c.Addr,
+		url.QueryEscape(index))
+
+	r, err := c.Do("PUT", reqURL, body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK {
+		return nil
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// GetAliasIndices returns the indices of the alias, nil if the alias doesn't exist.
+func (c *Client) GetAliasIndices(alias string) ([]string, error) {
+	reqURL := fmt.Sprintf("%s://%s/_alias/%s", c.Protocol, c.Addr,
+		url.QueryEscape(alias))
+
+	resp, err := c.DoRequest("GET", reqURL, bytes.NewBuffer(nil))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Error: %s, code: %d", http.StatusText(resp.StatusCode), resp.StatusCode)
+	}
+
+	var m map[string]json.RawMessage
+	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	indices := make([]string, 0, len(m))
+	for index := range m {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	return indices, nil
+}
+
+// UpdateAliases performs the alias actions atomically, see
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/indices-aliases.html
+func (c *Client) UpdateAliases(actions []map[string]interface{}) error {
+	reqURL := fmt.Sprintf("%s://%s/_aliases", c.Protocol, c.Addr)
+
+	r, err := c.Do("POST", reqURL, map[string]interface{}{"actions": actions})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK {
+		return nil
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
+// SwapAlias moves the alias from the current indices to index atomically.
+// If alias is a concrete index now, the index is deleted in the same request,
+// because an alias can't have the same name as an index.
+func (c *Client) SwapAlias(alias string, index string) error {
+	indices, err := c.GetAliasIndices(alias)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var actions []map[string]interface{}
+	if len(indices) > 0 {
+		for _, i := range indices {
+			if i == index {
+				continue
+			}
+			actions = append(actions, map[string]interface{}{
+				"remove": map[string]string{"index": i, "alias": alias},
+			})
+		}
+	} else {
+		exists, err := c.IndexExists(alias)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if exists {
+			actions = append(actions, map[string]interface{}{
+				"remove_index": map[string]string{"index": alias},
+			})
+		}
+	}
+
+	actions = append(actions, map[string]interface{}{
+		"add": map[string]string{"index": index, "alias": alias},
+	})
+
+	return errors.Trace(c.UpdateAliases(actions))
+}
+
+// DeleteByQuery deletes the docs matching the query in the index, see
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-delete-by-query.html
+func (c *Client) DeleteByQuery(index string, query map[string]interface{}) error {
+	reqURL := fmt.Sprintf("%s://%s/%s/_delete_by_query?conflicts=proceed", c.Protocol, c.Addr,
+		url.QueryEscape(index))
+
+	return c.doByQuery(reqURL, map[string]interface{}{"query": query})
+}
+
+// UpdateByQuery updates the docs in the index with the script and query in body, see
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-update-by-query.html
+func (c *Client) UpdateByQuery(index string, body map[string]interface{}) error {
+	reqURL := fmt.Sprintf("%s://%s/%s/_update_by_query?conflicts=proceed", c.Protocol, c.Addr,
+		url.QueryEscape(index))
+
+	return c.doByQuery(reqURL, body)
+}
+
+func (c *Client) doByQuery(reqURL string, body map[string]interface{}) error {
+	r, err := c.Do("POST", reqURL, body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if r.Code == http.StatusOK {
+		return nil
+	}
+
+	return errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+}
+
 // Get gets the item by id.
 func (c *Client) Get(index string, docType string, id string) (*Response, error) {
-	reqURL := fmt.Sprintf("%s://%s/%s/%s/%s", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType),
-		url.QueryEscape(id))
+	reqURL := c.docURL(index, docType, id)
 
 	return c.Do("GET", reqURL, nil)
 }
 
 // Update creates or updates the data
 func (c *Client) Update(index string, docType string, id string, data map[string]interface{}) error {
-	reqURL := fmt.Sprintf("%s://%s/%s/%s/%s", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType),
-		url.QueryEscape(id))
+	reqURL := c.docURL(index, docType, id)
 
 	r, err := c.Do("PUT", reqURL, data)
 	if err != nil {
@@ -371,10 +938,7 @@ func (c *Client) Update(index string, docType string, id string, data map[string
 
 // Exists checks whether id exists or not.
 func (c *Client) Exists(index string, docType string, id string) (bool, error) {
-	reqURL := fmt.Sprintf("%s://%s/%s/%s/%s", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType),
-		url.QueryEscape(id))
+	reqURL := c.docURL(index, docType, id)
 
 	r, err := c.Do("HEAD", reqURL, nil)
 	if err != nil {
@@ -386,10 +950,7 @@ func (c *Client) Exists(index string, docType string, id string) (bool, error) {
 
 // Delete deletes the item by id.
 func (c *Client) Delete(index string, docType string, id string) error {
-	reqURL := fmt.Sprintf("%s://%s/%s/%s/%s", c.Protocol, c.Addr,
-		url.QueryEscape(index),
-		url.QueryEscape(docType),
-		url.QueryEscape(id))
+	reqURL := c.docURL(index, docType, id)
 
 	r, err := c.Do("DELETE", reqURL, nil)
 	if err != nil {
@@ -420,7 +981,12 @@ func (c *Client) IndexBulk(index string, items []*BulkRequest) (*BulkResponse, e
 }
 
 // IndexTypeBulk sends the bulk request for index and doc type.
+// For the typeless APIs, it is the same as IndexBulk.
 func (c *Client) IndexTypeBulk(index string, docType string, items []*BulkRequest) (*BulkResponse, error) {
+	if c.Typeless() {
+		return c.IndexBulk(index, items)
+	}
+
 	reqURL := fmt.Sprintf("%s://%s/%s/%s/_bulk", c.Protocol, c.Addr,
 		url.QueryEscape(index),
 		url.QueryEscape(docType))
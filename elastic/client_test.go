@@ -1,8 +1,17 @@
 package elastic
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
 	"testing"
 
 	. "github.com/pingcap/check"
@@ -143,3 +152,373 @@ func (s *elasticTestSuite) TestParent(c *C) {
 	c.Assert(resp.Code, Equals, 200)
 	c.Assert(resp.Errors, Equals, false)
 }
+
+func (s *elasticTestSuite) TestTypeless(c *C) {
+	var paths []string
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		data, _ := ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/":
+			w.Write([]byte(`{"version": {"number": "7.10.2"}}`))
+		case "/dummy/_mapping":
+			w.Write([]byte(`{"dummy": {"mappings": {"properties": {"name": {"type": "text"}}}}}`))
+		case "/_bulk":
+			body = string(data)
+			w.Write([]byte(`{"took": 1, "errors": false, "items": []}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer ts.Close()
+
+	cfg := new(ClientConfig)
+	cfg.Addr = strings.TrimPrefix(ts.URL, "http://")
+	client := NewClient(cfg)
+
+	err := client.DetectVersion()
+	c.Assert(err, IsNil)
+	c.Assert(client.Version, Equals, "7.10.2")
+	c.Assert(client.Typeless(), IsTrue)
+
+	_, err = client.Get("dummy", "blog", "1")
+	c.Assert(err, IsNil)
+	c.Assert(paths[len(paths)-1], Equals, "GET /dummy/_doc/1")
+
+	m, err := client.GetMapping("dummy", "blog")
+	c.Assert(err, IsNil)
+	c.Assert(m.Mapping["dummy"].Mappings["blog"].Properties["name"].Type, Equals, "text")
+
+	items := []*BulkRequest{
+		{Action: ActionIndex, Index: "dummy", Type: "blog", ID: "1", Parent: "2", Data: makeTestData("abc", "hello world")},
+	}
+	_, err = client.Bulk(items)
+	c.Assert(err, IsNil)
+	c.Assert(body, Equals, `{"index":{"_id":"1","_index":"dummy","routing":"2"}}`+"\n"+
+		`{"content":"hello world","name":"abc"}`+"\n")
+}
+
+func (s *elasticTestSuite) TestMultiNodes(c *C) {
+	var hits int
+	alive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte(`{"_id": "1", "found": true}`))
+	}))
+	defer alive.Close()
+
+	// a closed server to refuse connections
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+
+	cfg := new(ClientConfig)
+	cfg.Addrs = []string{strings.TrimPrefix(dead.URL, "http://"), strings.TrimPrefix(alive.URL, "http://")}
+	cfg.Version = "6.8.0"
+	client := NewClient(cfg)
+	defer client.Close()
+
+	for i := 0; i < 4; i++ {
+		r, err := client.Get("dummy", "blog", "1")
+		c.Assert(err, IsNil)
+		c.Assert(r.Found, IsTrue)
+	}
+
+	c.Assert(hits, Equals, 4)
+	c.Assert(client.nodes.deadNodes(), HasLen, 1)
+	c.Assert(client.nodes.deadNodes()[0].addr, Equals, cfg.Addrs[0])
+}
+
+func (s *elasticTestSuite) TestTLS(c *C) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"_id": "1", "found": true}`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "es_tls")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	caFile := path.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	c.Assert(ioutil.WriteFile(caFile, ca, 0644), IsNil)
+
+	get := func(tlsConfig *tls.Config) error {
+		cfg := new(ClientConfig)
+		cfg.HTTPS = true
+		cfg.Addr = strings.TrimPrefix(server.URL, "https://")
+		cfg.Version = "6.8.0"
+		cfg.TLSConfig = tlsConfig
+		client := NewClient(cfg)
+		defer client.Close()
+
+		_, err := client.Get("dummy", "blog", "1")
+		return err
+	}
+
+	// the self-signed certificate is verified by default
+	c.Assert(get(nil), NotNil)
+
+	tlsConfig, err := NewTLSConfig("", "", "", "", true)
+	c.Assert(err, IsNil)
+	c.Assert(get(tlsConfig), IsNil)
+
+	tlsConfig, err = NewTLSConfig(caFile, "", "", "example.com", false)
+	c.Assert(err, IsNil)
+	c.Assert(get(tlsConfig), IsNil)
+
+	_, err = NewTLSConfig(path.Join(dir, "none.pem"), "", "", "", false)
+	c.Assert(err, NotNil)
+	_, err = NewTLSConfig("", caFile, "", "", false)
+	c.Assert(err, NotNil)
+}
+
+func (s *elasticTestSuite) TestAuthHeaders(c *C) {
+	var headers []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header)
+		w.Write([]byte(`{"errors": false, "items": []}`))
+	}))
+	defer server.Close()
+
+	cfg := new(ClientConfig)
+	cfg.Addr = strings.TrimPrefix(server.URL, "http://")
+	cfg.Version = "7.10.2"
+	cfg.User = "user"
+	cfg.Password = "pass"
+	cfg.APIKey = "key"
+	cfg.Headers = map[string]string{"X-Tenant": "search"}
+	client := NewClient(cfg)
+	defer client.Close()
+
+	_, err := client.Bulk([]*BulkRequest{{Action: ActionIndex, Index: "dummy", ID: "1", Data: map[string]interface{}{"a": 1}}})
+	c.Assert(err, IsNil)
+
+	client.APIKey = ""
+	client.BearerToken = "token"
+	_, err = client.Get("dummy", "_doc", "1")
+	c.Assert(err, IsNil)
+
+	client.BearerToken = ""
+	_, err = client.Get("dummy", "_doc", "1")
+	c.Assert(err, IsNil)
+
+	c.Assert(headers, HasLen, 3)
+	c.Assert(headers[0].Get("Authorization"), Equals, "ApiKey key")
+	c.Assert(headers[0].Get("X-Tenant"), Equals, "search")
+	c.Assert(headers[1].Get("Authorization"), Equals, "Bearer token")
+	c.Assert(headers[2].Get("Authorization"), Equals, "Basic dXNlcjpwYXNz")
+	c.Assert(headers[2].Get("X-Tenant"), Equals, "search")
+}
+
+func (s *elasticTestSuite) TestBulkBadGateway(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, "<html><body>502 Bad Gateway</body></html>")
+	}))
+	defer server.Close()
+
+	cfg := new(ClientConfig)
+	cfg.Addr = strings.TrimPrefix(server.URL, "http://")
+	cfg.Version = "7.10.2"
+	client := NewClient(cfg)
+	defer client.Close()
+
+	items := []*BulkRequest{{Action: ActionIndex, Index: "dummy", ID: "1", Data: map[string]interface{}{"a": 1}}}
+	resp, err := client.Bulk(items)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Code, Equals, http.StatusBadGateway)
+}
+
+func (s *elasticTestSuite) TestBulkMaxBytes(c *C) {
+	var sizes []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		sizes = append(sizes, len(data))
+
+		var items []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if strings.HasPrefix(line, `{"index"`) {
+				items = append(items, `{"index": {"_id": "x", "status": 201}}`)
+			}
+		}
+		fmt.Fprintf(w, `{"errors": false, "items": [%s]}`, strings.Join(items, ","))
+	}))
+	defer server.Close()
+
+	cfg := new(ClientConfig)
+	cfg.Addr = strings.TrimPrefix(server.URL, "http://")
+	cfg.Version = "7.10.2"
+	cfg.BulkMaxBytes = 200
+	client := NewClient(cfg)
+	defer client.Close()
+
+	var items []*BulkRequest
+	for i := 0; i < 10; i++ {
+		content := "small"
+		if i == 5 {
+			content = strings.Repeat("large", 100)
+		}
+		items = append(items, &BulkRequest{
+			Action: ActionIndex,
+			Index:  "dummy",
+			ID:     fmt.Sprintf("%d", i),
+			Data:   map[string]interface{}{"content": content},
+		})
+	}
+
+	resp, err := client.Bulk(items)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Errors, IsTrue)
+	c.Assert(resp.Items, HasLen, 10)
+	c.Assert(resp.Items[5][ActionIndex].Status, Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(resp.Items[5][ActionIndex].ID, Equals, "5")
+	c.Assert(resp.Items[4][ActionIndex].Status, Equals, http.StatusCreated)
+
+	c.Assert(len(sizes) > 2, IsTrue)
+	for _, size := range sizes {
+		c.Assert(size <= cfg.BulkMaxBytes, IsTrue)
+	}
+}
+
+func (s *elasticTestSuite) TestBulkMaxBytesPartial(c *C) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		data, _ := ioutil.ReadAll(r.Body)
+		if requests == 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		var items []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if strings.HasPrefix(line, `{"index"`) {
+				items = append(items, `{"index": {"_id": "x", "status": 201}}`)
+			}
+		}
+		fmt.Fprintf(w, `{"errors": false, "items": [%s]}`, strings.Join(items, ","))
+	}))
+	defer server.Close()
+
+	cfg := new(ClientConfig)
+	cfg.Addr = strings.TrimPrefix(server.URL, "http://")
+	cfg.Version = "7.10.2"
+	cfg.BulkMaxBytes = 200
+	client := NewClient(cfg)
+	defer client.Close()
+
+	var items []*BulkRequest
+	for i := 0; i < 10; i++ {
+		items = append(items, &BulkRequest{
+			Action: ActionIndex,
+			Index:  "dummy",
+			ID:     fmt.Sprintf("%d", i),
+			Data:   map[string]interface{}{"content": "small"},
+		})
+	}
+
+	resp, err := client.Bulk(items)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Errors, IsTrue)
+	c.Assert(resp.Items, HasLen, 10)
+	c.Assert(resp.Items[0][ActionIndex].Status, Equals, http.StatusCreated)
+	c.Assert(resp.Items[9][ActionIndex].Status, Equals, http.StatusBadGateway)
+	c.Assert(resp.Items[9][ActionIndex].ID, Equals, "9")
+	c.Assert(requests, Equals, 2)
+}
+
+func (s *elasticTestSuite) TestSwapAlias(c *C) {
+	var aliasIndices string
+	var actions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/_alias/test":
+			if len(aliasIndices) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(aliasIndices))
+		case r.Method == "HEAD" && r.URL.Path == "/test":
+			// test is a concrete index
+		case r.Method == "POST" && r.URL.Path == "/_aliases":
+			data, _ := ioutil.ReadAll(r.Body)
+			actions = append(actions, string(data))
+			w.Write([]byte(`{"acknowledged": true}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cfg := new(ClientConfig)
+	cfg.Addr = strings.TrimPrefix(server.URL, "http://")
+	cfg.Version = "7.10.2"
+	client := NewClient(cfg)
+	defer client.Close()
+
+	err := client.SwapAlias("test", "test_v1")
+	c.Assert(err, IsNil)
+
+	aliasIndices = `{"test_v1": {"aliases": {"test": {}}}}`
+	err = client.SwapAlias("test", "test_v2")
+	c.Assert(err, IsNil)
+
+	c.Assert(actions, DeepEquals, []string{
+		`{"actions":[{"remove_index":{"index":"test"}},{"add":{"alias":"test","index":"test_v1"}}]}`,
+		`{"actions":[{"remove":{"alias":"test","index":"test_v1"}},{"add":{"alias":"test","index":"test_v2"}}]}`,
+	})
+}
+
+func (s *elasticTestSuite) TestBulkUpdateBody(c *C) {
+	tests := []struct {
+		req    *BulkRequest
+		expect string
+	}{
+		{
+			&BulkRequest{Action: ActionUpdate, Index: "dummy", ID: "1", Data: map[string]interface{}{"a": 1}},
+			`{"doc":{"a":1}}`,
+		},
+		{
+			&BulkRequest{Action: ActionUpdate, Index: "dummy", ID: "1", Data: map[string]interface{}{"a": 1}, DocAsUpsert: true},
+			`{"doc":{"a":1},"doc_as_upsert":true}`,
+		},
+		{
+			&BulkRequest{Action: ActionUpdate, Index: "dummy", ID: "1", Script: map[string]interface{}{"source": "x"}, ScriptedUpsert: true},
+			`{"script":{"source":"x"},"scripted_upsert":true,"upsert":{}}`,
+		},
+		{
+			&BulkRequest{Action: ActionUpdate, Index: "dummy", ID: "1", Script: map[string]interface{}{"source": "x"},
+				Upsert: map[string]interface{}{"a": 1}},
+			`{"script":{"source":"x"},"upsert":{"a":1}}`,
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		c.Assert(test.req.bulk(&buf, true), IsNil)
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		c.Assert(lines, HasLen, 2)
+		c.Assert(lines[0], Equals, `{"update":{"_id":"1","_index":"dummy"}}`)
+		c.Assert(lines[1], Equals, test.expect)
+	}
+}
+
+func (s *elasticTestSuite) TestBulkVersionMeta(c *C) {
+	req := &BulkRequest{Action: ActionIndex, Index: "dummy", ID: "1", Data: map[string]interface{}{"a": 1},
+		Version: 12<<32 | 154, VersionType: VersionTypeExternal}
+
+	var buf bytes.Buffer
+	c.Assert(req.bulk(&buf, true), IsNil)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(lines[0], Equals, `{"index":{"_id":"1","_index":"dummy","version":51539607706,"version_type":"external"}}`)
+
+	buf.Reset()
+	req = &BulkRequest{Action: ActionDelete, Index: "dummy", ID: "1"}
+	c.Assert(req.bulk(&buf, true), IsNil)
+	c.Assert(strings.TrimSpace(buf.String()), Equals, `{"delete":{"_id":"1","_index":"dummy"}}`)
+}
@@ -0,0 +1,148 @@
+package elastic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/siddontang/go-log/log"
+)
+
+const defaultHealthCheckInterval = 10 * time.Second
+
+type node struct {
+	addr string
+	dead bool
+}
+
+// nodePool picks the ES nodes in round-robin, the dead nodes are skipped
+// until the health checker finds they are alive again.
+type nodePool struct {
+	sync.Mutex
+
+	nodes []*node
+	next  int
+}
+
+func newNodePool(addrs []string) *nodePool {
+	p := new(nodePool)
+	for _, addr := range addrs {
+		p.nodes = append(p.nodes, &node{addr: addr})
+	}
+	return p
+}
+
+func (p *nodePool) has(addr string) bool {
+	for _, n := range p.nodes {
+		if n.addr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns the next alive node, if all nodes are dead, we still
+// return one in order, maybe it is alive now.
+func (p *nodePool) pick() *node {
+	p.Lock()
+	defer p.Unlock()
+
+	for i := 0; i < len(p.nodes); i++ {
+		idx := (p.next + i) % len(p.nodes)
+		if n := p.nodes[idx]; !n.dead {
+			p.next = (idx + 1) % len(p.nodes)
+			return n
+		}
+	}
+
+	n := p.nodes[p.next]
+	p.next = (p.next + 1) % len(p.nodes)
+	return n
+}
+
+func (p *nodePool) markDead(n *node, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if !n.dead {
+		log.Errorf("mark Elasticsearch node %s dead, err %v", n.addr, err)
+		n.dead = true
+	}
+}
+
+func (p *nodePool) markAlive(n *node) {
+	p.Lock()
+	defer p.Unlock()
+
+	if n.dead {
+		log.Infof("Elasticsearch node %s is alive again", n.addr)
+		n.dead = false
+	}
+}
+
+func (p *nodePool) deadNodes() []*node {
+	p.Lock()
+	defer p.Unlock()
+
+	var nodes []*node
+	for _, n := range p.nodes {
+		if n.dead {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// isDialError checks whether the request failed before being sent,
+// so it is safe to send it to another node.
+func isDialError(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+
+	oe, ok := err.(*net.OpError)
+	return ok && oe.Op == "dial"
+}
+
+// healthCheck probes the dead nodes periodically until the client is closed.
+func (c *Client) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.closeCh:
+			return
+		}
+
+		for _, n := range c.nodes.deadNodes() {
+			if c.probe(n, interval) {
+				c.nodes.markAlive(n)
+			}
+		}
+	}
+}
+
+func (c *Client) probe(n *node, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("HEAD", fmt.Sprintf("%s://%s/", c.Protocol, n.addr), nil)
+	if err != nil {
+		return false
+	}
+	c.setAuth(req)
+
+	resp, err := c.c.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode < http.StatusInternalServerError
+}
@@ -0,0 +1,48 @@
+package elastic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/juju/errors"
+)
+
+// NewTLSConfig creates the TLS configuration for the client.
+// caFile is the CA bundle to verify the server, the system roots are used if empty.
+// certFile and keyFile are the client certificate and key for mutual TLS, both must be set or empty.
+// serverName overrides the host name to verify the server certificate.
+// insecure skips verifying the server certificate, only use it for testing.
+func NewTLSConfig(caFile, certFile, keyFile, serverName string, insecure bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecure,
+	}
+
+	if len(caFile) > 0 {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no valid certificate in CA file %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		if len(certFile) == 0 || len(keyFile) == 0 {
+			return nil, errors.Errorf("both client certificate and key must be set")
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
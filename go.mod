@@ -6,6 +6,7 @@ require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/juju/errors v0.0.0-20190207033735-e65537c515d7
 	github.com/pingcap/check v0.0.0-20190102082844-67f458068fc8
+	github.com/pingcap/parser v0.0.0-20190506092653-e336082eb825
 	github.com/prometheus/client_golang v0.9.3
 	github.com/siddontang/go v0.0.0-20180604090527-bdc77568d726
 	github.com/siddontang/go-log v0.0.0-20190221022429-1e957dd83bed
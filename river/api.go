@@ -0,0 +1,81 @@
+package river
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/siddontang/go-log/log"
+)
+
+// initStatus serves the metrics and the HTTP API at stat_addr.
+func (r *River) initStatus() {
+	mux := http.NewServeMux()
+	mux.Handle(r.c.StatPath, promhttp.Handler())
+	mux.HandleFunc("/snapshot", r.handleSnapshot)
+	mux.HandleFunc("/reindex", r.handleReindex)
+
+	if err := http.ListenAndServe(r.c.StatAddr, mux); err != nil {
+		log.Errorf("serve status at %s err %v", r.c.StatAddr, err)
+	}
+}
+
+// handleSnapshot re-snapshots the table, like POST /snapshot?table=schema.table.
+func (r *River) handleSnapshot(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	table := req.FormValue("table")
+	if len(table) == 0 {
+		http.Error(w, "table is required", http.StatusBadRequest)
+		return
+	}
+
+	keys, err := r.Resnapshot(table)
+	r.writeTaskResponse(w, keys, err)
+}
+
+// handleReindex reindexes the index to a new index and moves the alias,
+// like POST /reindex?index=test&target=test_v2. It must be enabled with reindex_api.
+func (r *River) handleReindex(w http.ResponseWriter, req *http.Request) {
+	if !r.c.ReindexAPI {
+		http.Error(w, "reindex API is disabled, set reindex_api = true to enable it", http.StatusForbidden)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	index := req.FormValue("index")
+	target := req.FormValue("target")
+	if len(index) == 0 || len(target) == 0 {
+		http.Error(w, "index and target are required", http.StatusBadRequest)
+		return
+	}
+
+	keys, err := r.Reindex(index, target)
+	r.writeTaskResponse(w, keys, err)
+}
+
+// writeTaskResponse writes the tables of the background task, or the error.
+func (r *River) writeTaskResponse(w http.ResponseWriter, keys []string, err error) {
+	if err != nil {
+		code := http.StatusBadRequest
+		switch errors.Cause(err) {
+		case ErrRuleNotExist:
+			code = http.StatusNotFound
+		case ErrSnapshotRunning:
+			code = http.StatusConflict
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string][]string{"tables": keys})
+}
@@ -0,0 +1,52 @@
+package river
+
+// columnPlan is how to sync a column of the table, so we don't need to check
+// the filters and the field mapping for every column of every row.
+type columnPlan struct {
+	synced bool
+	// mapped is true if the column is in the field mapping
+	mapped    bool
+	field     string
+	fieldType string
+}
+
+// prepareColumns builds the column plan of the rule, it must be called after
+// TableInfo, the filters or the field mapping are changed.
+func (r *River) prepareColumns(rule *Rule) {
+	rule.columns = r.newColumnPlan(rule)
+	rule.columnsTable = rule.TableInfo
+}
+
+func (r *River) newColumnPlan(rule *Rule) []columnPlan {
+	if rule.TableInfo == nil {
+		return nil
+	}
+
+	plans := make([]columnPlan, len(rule.TableInfo.Columns))
+	for i, c := range rule.TableInfo.Columns {
+		if !rule.CheckFilter(c.Name) {
+			continue
+		}
+
+		plan := columnPlan{synced: true, field: c.Name}
+		for k, v := range rule.FieldMapping {
+			mysql, elastic, fieldType := r.getFieldParts(k, v)
+			if mysql == c.Name {
+				plan.mapped = true
+				plan.field = elastic
+				plan.fieldType = fieldType
+			}
+		}
+		plans[i] = plan
+	}
+	return plans
+}
+
+// columnPlan returns the column plan of the rule, it is built again if
+// TableInfo is changed but the plan is not prepared.
+func (r *River) columnPlan(rule *Rule) []columnPlan {
+	if rule.columnsTable == rule.TableInfo && len(rule.columns) == len(rule.TableInfo.Columns) {
+		return rule.columns
+	}
+	return r.newColumnPlan(rule)
+}
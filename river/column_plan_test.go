@@ -0,0 +1,72 @@
+package river
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func TestColumnPlan(t *testing.T) {
+	table := &schema.Table{Schema: "test", Name: "test_river"}
+	for _, c := range []string{"id", "name", "password_hash", "ssn", "meta_a", "meta_b", "tags"} {
+		table.AddColumn(c, "varchar(256)", "", "")
+	}
+	table.PKColumns = []int{0}
+
+	tests := []struct {
+		Rule   Rule
+		Expect []string
+	}{
+		{Rule{}, []string{"id", "name", "password_hash", "ssn", "meta_a", "meta_b", "tags"}},
+		{Rule{Exclude: []string{"password_hash", "ssn"}}, []string{"id", "name", "meta_a", "meta_b", "tags"}},
+		{Rule{IncludeRegex: []string{"^meta_", "^id$"}}, []string{"id", "meta_a", "meta_b"}},
+		{Rule{ExcludeRegex: []string{"^meta_", "ss"}}, []string{"id", "name", "tags"}},
+		{Rule{Filter: []string{"id", "ssn", "meta_a"}, Exclude: []string{"ssn"}, ExcludeRegex: []string{"_a$"}}, []string{"id"}},
+	}
+
+	r := new(River)
+	for i, test := range tests {
+		rule := test.Rule
+		rule.Schema, rule.Table = "test", "test_river"
+		if err := rule.prepare(); err != nil {
+			t.Fatal(err)
+		}
+		rule.TableInfo = table
+		r.prepareColumns(&rule)
+
+		var synced []string
+		for j, plan := range r.columnPlan(&rule) {
+			if plan.synced {
+				synced = append(synced, table.Columns[j].Name)
+			}
+		}
+		if !reflect.DeepEqual(synced, test.Expect) {
+			t.Errorf("Test %d, Expected: %v, but: was %v", i, test.Expect, synced)
+		}
+	}
+
+	rule := &Rule{Schema: "test", Table: "test_river", FieldMapping: map[string]string{"tags": "es_tags,list"}}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = table
+	r.prepareColumns(rule)
+
+	if plan := r.columnPlan(rule)[6]; !plan.mapped || plan.field != "es_tags" || plan.fieldType != fieldTypeList {
+		t.Errorf("Expected tags is mapped to es_tags with list type, but: was %+v", plan)
+	}
+
+	// the plan is rebuilt if the table is changed
+	altered := &schema.Table{Schema: "test", Name: "test_river"}
+	altered.AddColumn("id", "int(11)", "", "")
+	rule.TableInfo = altered
+	if plans := r.columnPlan(rule); len(plans) != 1 || !plans[0].synced {
+		t.Errorf("Expected the plan of the altered table, but: was %+v", plans)
+	}
+
+	rule = &Rule{Schema: "test", Table: "test_river", IncludeRegex: []string{"("}}
+	if err := rule.prepare(); err == nil {
+		t.Errorf("Expected invalid regexp error")
+	}
+}
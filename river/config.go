@@ -26,16 +26,51 @@ type Config struct {
 	ESUser     string `toml:"es_user"`
 	ESPassword string `toml:"es_pass"`
 
+	// If not set, get it from the ES server.
+	ESVersion string `toml:"es_version"`
+
+	// The interval to probe the dead ES nodes if there are multiple nodes in es_addr.
+	ESHealthCheckInterval TomlDuration `toml:"es_health_check_interval"`
+
+	// Authorization instead of es_user and es_pass, es_api_key is preferred.
+	ESAPIKey      string            `toml:"es_api_key"`
+	ESBearerToken string            `toml:"es_bearer_token"`
+	ESHeaders     map[string]string `toml:"es_headers"`
+
+	// TLS settings if es_https is true.
+	ESTLSCA         string `toml:"es_tls_ca"`
+	ESTLSCert       string `toml:"es_tls_cert"`
+	ESTLSKey        string `toml:"es_tls_key"`
+	ESTLSServerName string `toml:"es_tls_server_name"`
+	ESTLSSkipVerify bool   `toml:"es_tls_skip_verify"`
+
 	StatAddr string `toml:"stat_addr"`
 	StatPath string `toml:"stat_path"`
 
+	// Enable POST /reindex at stat_addr, which has no authentication and may delete an index.
+	ReindexAPI bool `toml:"reindex_api"`
+
 	ServerID uint32 `toml:"server_id"`
 	Flavor   string `toml:"flavor"`
 	DataDir  string `toml:"data_dir"`
 
+	// position or gtid, see checkpointModePosition and checkpointModeGTID.
+	CheckpointMode string `toml:"checkpoint_mode"`
+
+	// Where to save the sync position: file, mysql or elasticsearch.
+	PositionStore  string `toml:"position_store"`
+	PositionKey    string `toml:"position_key"`
+	PositionSchema string `toml:"position_schema"`
+	PositionTable  string `toml:"position_table"`
+	PositionIndex  string `toml:"position_index"`
+
 	DumpExec       string `toml:"mysqldump"`
 	SkipMasterData bool   `toml:"skip_master_data"`
 
+	// mysqldump or native, native reads the tables in primary key chunks without mysqldump.
+	SnapshotMode      string `toml:"snapshot_mode"`
+	SnapshotChunkSize int    `toml:"snapshot_chunk_size"`
+
 	Sources []SourceConfig `toml:"source"`
 
 	Rules []*Rule `toml:"rule"`
@@ -44,7 +79,28 @@ type Config struct {
 
 	FlushBulkTime TomlDuration `toml:"flush_bulk_time"`
 
+	// The max payload bytes of one bulk request, the bulk is split into multiple requests if larger.
+	BulkMaxBytes int `toml:"bulk_max_bytes"`
+
+	// The number of the workers to send bulk requests concurrently,
+	// the requests for the same document are always sent by the same worker.
+	BulkWorkers int `toml:"bulk_workers"`
+
+	// Retry policy for bulk requests failed with transport errors or 429/5xx responses.
+	BulkRetryMaxAttempts    int          `toml:"bulk_retry_max_attempts"`
+	BulkRetryInitialBackoff TomlDuration `toml:"bulk_retry_initial_backoff"`
+	BulkRetryMaxBackoff     TomlDuration `toml:"bulk_retry_max_backoff"`
+	BulkRetryJitter         float64      `toml:"bulk_retry_jitter"`
+
 	SkipNoPkTable bool `toml:"skip_no_pk_table"`
+
+	// Check whether the synced columns are compatible with the existing ES fields
+	// at startup and after DDL: off, warn or error.
+	MappingCheck string `toml:"mapping_check"`
+
+	// Write the docs with the external version built from the binlog coordinate: off, position or gtid,
+	// so ES rejects the stale writes, see externalVersionPosition and externalVersionGTID.
+	ExternalVersion string `toml:"external_version"`
 }
 
 // NewConfigWithFile creates a Config from file.
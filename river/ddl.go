@@ -0,0 +1,343 @@
+package river
+
+import (
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/parser/ast"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// The policies to handle the DDL of the table in rule.
+const (
+	// ddlIgnore does nothing, it is the default policy.
+	ddlIgnore = "ignore"
+
+	// ddl_add_column: ddlPutMapping puts the mapping of the new columns to ES.
+	ddlPutMapping = "mapping"
+
+	// ddl_rename_column: ddlKeepField keeps syncing the column to the old ES field,
+	// ddlRenameField renames the field in the existing docs to the new column name.
+	ddlKeepField   = "keep"
+	ddlRenameField = "rename"
+
+	// ddl_drop_table: ddlStop stops syncing the table, ddlDeleteIndex deletes the index too.
+	ddlStop        = "stop"
+	ddlDeleteIndex = "delete_index"
+
+	// ddl_truncate_table: ddlDeleteDocs deletes all the docs in the index.
+	ddlDeleteDocs = "delete_docs"
+)
+
+func checkDDLPolicy(name string, policy string, valid ...string) error {
+	if len(policy) == 0 || policy == ddlIgnore {
+		return nil
+	}
+
+	for _, v := range valid {
+		if policy == v {
+			return nil
+		}
+	}
+
+	return errors.Errorf("invalid %s %s, must be %s or %s", name, policy, ddlIgnore, strings.Join(valid, ", "))
+}
+
+// handleDDL handles the DDL of the tables in rules by the policies. The table info
+// of the rule is already updated in OnTableChanged before.
+func (r *River) handleDDL(nextPos mysql.Position, e *replication.QueryEvent) error {
+	// canal calls OnDDL for every statement in the query, we handle all of them at the first time.
+	if nextPos == r.lastDDLPos {
+		return nil
+	}
+	r.lastDDLPos = nextPos
+
+	stmts, _, err := r.parser.Parse(string(e.Query), "", "")
+	if err != nil {
+		log.Errorf("parse DDL %s err %v, ignore it", e.Query, err)
+		return nil
+	}
+
+	for _, stmt := range stmts {
+		switch t := stmt.(type) {
+		case *ast.CreateTableStmt:
+			if err = r.addDDLWildcardTable(e, t.Table); err != nil {
+				return errors.Trace(err)
+			}
+		case *ast.RenameTableStmt:
+			for _, tt := range t.TableToTables {
+				if err = r.addDDLWildcardTable(e, tt.NewTable); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		case *ast.AlterTableStmt:
+			for _, spec := range t.Specs {
+				if spec.Tp == ast.AlterTableRenameTable {
+					if err = r.addDDLWildcardTable(e, spec.NewTable); err != nil {
+						return errors.Trace(err)
+					}
+				}
+			}
+
+			rule := r.ddlRule(e, t.Table)
+			if rule == nil {
+				continue
+			}
+
+			for _, spec := range t.Specs {
+				switch spec.Tp {
+				case ast.AlterTableAddColumns:
+					if rule.DDLAddColumn != ddlPutMapping {
+						continue
+					}
+
+					columns := make([]string, 0, len(spec.NewColumns))
+					for _, c := range spec.NewColumns {
+						columns = append(columns, c.Name.Name.O)
+					}
+
+					if err = r.putColumnsMapping(rule, columns); err != nil {
+						return errors.Trace(err)
+					}
+				case ast.AlterTableChangeColumn:
+					if len(spec.NewColumns) == 0 {
+						continue
+					}
+
+					oldName, newName := spec.OldColumnName.Name.O, spec.NewColumns[0].Name.Name.O
+					if oldName == newName {
+						continue
+					}
+
+					if err = r.renameColumn(rule, oldName, newName); err != nil {
+						return errors.Trace(err)
+					}
+				}
+			}
+
+			if err = r.checkDDLMapping(rule); err != nil {
+				return errors.Trace(err)
+			}
+		case *ast.DropTableStmt:
+			for _, table := range t.Tables {
+				if rule := r.ddlRule(e, table); rule != nil {
+					if err = r.dropTable(rule); err != nil {
+						return errors.Trace(err)
+					}
+				}
+			}
+		case *ast.TruncateTableStmt:
+			if rule := r.ddlRule(e, t.Table); rule != nil {
+				if err = r.truncateTable(rule); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// ddlRule returns the rule of the table in DDL, nil if the table is not synced.
+func (r *River) ddlRule(e *replication.QueryEvent, table *ast.TableName) *Rule {
+	schema := table.Schema.O
+	if len(schema) == 0 {
+		schema = string(e.Schema)
+	}
+
+	return r.rules[ruleKey(schema, table.Name.O)]
+}
+
+// addDDLWildcardTable adds the rule of the table created or renamed if it matches a wildcard table,
+// canal only tells us the old table is changed when renaming a table.
+func (r *River) addDDLWildcardTable(e *replication.QueryEvent, table *ast.TableName) error {
+	schema := table.Schema.O
+	if len(schema) == 0 {
+		schema = string(e.Schema)
+	}
+
+	err := r.addWildcardTable(schema, table.Name.O)
+	if err != nil && err != ErrRuleNotExist {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// sendTask sends the task to run in the sync loop, the river is closed if the task fails.
+func (r *River) sendTask(fn func() error) error {
+	select {
+	case r.syncCh <- syncTask{fn: fn}:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// isIndexShared checks whether the index of rule is used by other rules too.
+func (r *River) isIndexShared(rule *Rule) bool {
+	if rule.isNested() {
+		// the docs belong to the parent table
+		return true
+	}
+
+	for _, other := range r.rules {
+		if other != rule && other.Index == rule.Index {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *River) putColumnsMapping(rule *Rule, columns []string) error {
+	properties := r.columnsMapping(rule, columns)
+	if len(properties) == 0 {
+		return nil
+	}
+
+	index, docType := rule.Index, rule.Type
+	mapping := map[string]interface{}{
+		docType: map[string]interface{}{
+			"properties": wrapNestedMapping(rule, properties),
+		},
+	}
+
+	log.Infof("put mapping of columns %v of %s.%s to index %s", columns, rule.Schema, rule.Table, index)
+	return r.sendTask(func() error {
+		return errors.Trace(r.es.CreateMapping(index, docType, mapping))
+	})
+}
+
+// renameColumn updates the rule after the column is renamed by CHANGE COLUMN.
+func (r *River) renameColumn(rule *Rule, oldName string, newName string) error {
+	if len(rule.DDLRenameColumn) == 0 || rule.DDLRenameColumn == ddlIgnore {
+		return nil
+	}
+
+	r.rulesLock.Lock()
+
+	// the field mapping and id may be shared with other tables by the wildcard rule
+	mapping := make(map[string]string, len(rule.FieldMapping))
+	for k, v := range rule.FieldMapping {
+		mapping[k] = v
+	}
+
+	v, mapped := mapping[oldName]
+	delete(mapping, oldName)
+
+	parts := strings.SplitN(v, ",", 2)
+	explicit := len(parts[0]) > 0
+	if !explicit && rule.DDLRenameColumn == ddlKeepField {
+		parts[0] = oldName
+	}
+	if mapped || rule.DDLRenameColumn == ddlKeepField {
+		mapping[newName] = strings.Join(parts, ",")
+	}
+	rule.FieldMapping = mapping
+
+	rule.ID = renameColumns(rule.ID, oldName, newName)
+	rule.Filter = renameColumns(rule.Filter, oldName, newName)
+	if rule.Parent == oldName {
+		rule.Parent = newName
+	}
+	if rule.rowFilter != nil {
+		rule.rowFilter = rule.rowFilter.renameColumn(oldName, newName)
+	}
+	rule.Exclude = renameColumns(rule.Exclude, oldName, newName)
+	rule.Lookups = renameLookups(rule.Lookups, oldName, newName)
+	r.prepareColumns(rule)
+
+	r.rulesLock.Unlock()
+
+	log.Infof("column %s of %s.%s is renamed to %s", oldName, rule.Schema, rule.Table, newName)
+
+	if explicit || rule.DDLRenameColumn != ddlRenameField {
+		return nil
+	}
+
+	if rule.isNested() {
+		log.Errorf("field %s in nested field %s of index %s can't be renamed, please reindex it",
+			oldName, rule.NestedField, rule.Index)
+		return nil
+	}
+
+	// the ES field is renamed too
+	index := rule.Index
+	body := map[string]interface{}{
+		"query": map[string]interface{}{
+			"exists": map[string]interface{}{"field": oldName},
+		},
+		"script": map[string]interface{}{
+			"source": "ctx._source[params.new] = ctx._source.remove(params.old)",
+			"params": map[string]interface{}{"old": oldName, "new": newName},
+		},
+	}
+
+	return r.sendTask(func() error {
+		log.Infof("rename field %s to %s in index %s", oldName, newName, index)
+		return errors.Trace(r.es.UpdateByQuery(index, body))
+	})
+}
+
+func renameColumns(columns []string, oldName string, newName string) []string {
+	if columns == nil {
+		return nil
+	}
+
+	renamed := make([]string, len(columns))
+	for i, c := range columns {
+		if c == oldName {
+			c = newName
+		}
+		renamed[i] = c
+	}
+	return renamed
+}
+
+func (r *River) dropTable(rule *Rule) error {
+	if rule.DDLDropTable != ddlStop && rule.DDLDropTable != ddlDeleteIndex {
+		return nil
+	}
+
+	log.Infof("table %s.%s is dropped, stop syncing it", rule.Schema, rule.Table)
+
+	shared := r.isIndexShared(rule)
+
+	r.rulesLock.Lock()
+	delete(r.rules, ruleKey(rule.Schema, rule.Table))
+	r.rulesLock.Unlock()
+
+	if rule.DDLDropTable != ddlDeleteIndex {
+		return nil
+	}
+
+	if shared {
+		log.Errorf("index %s is used by other tables, not delete it", rule.Index)
+		return nil
+	}
+
+	index := rule.Index
+	return r.sendTask(func() error {
+		log.Infof("delete index %s", index)
+		return errors.Trace(r.es.DeleteIndex(index))
+	})
+}
+
+func (r *River) truncateTable(rule *Rule) error {
+	if rule.DDLTruncateTable != ddlDeleteDocs {
+		return nil
+	}
+
+	if r.isIndexShared(rule) {
+		log.Errorf("table %s.%s is truncated, but index %s is used by other tables, not delete the docs",
+			rule.Schema, rule.Table, rule.Index)
+		return nil
+	}
+
+	index := rule.Index
+	return r.sendTask(func() error {
+		log.Infof("table %s.%s is truncated, delete all docs in index %s", rule.Schema, rule.Table, index)
+		return errors.Trace(r.es.DeleteByQuery(index, map[string]interface{}{"match_all": map[string]interface{}{}}))
+	})
+}
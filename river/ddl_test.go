@@ -0,0 +1,128 @@
+package river
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pingcap/parser"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+func TestDDLPolicy(t *testing.T) {
+	tests := []struct {
+		Rule  Rule
+		Valid bool
+	}{
+		{Rule{}, true},
+		{Rule{DDLAddColumn: "mapping", DDLRenameColumn: "rename", DDLDropTable: "delete_index", DDLTruncateTable: "delete_docs"}, true},
+		{Rule{DDLRenameColumn: "keep", DDLDropTable: "stop"}, true},
+		{Rule{DDLAddColumn: "ignore", DDLTruncateTable: "ignore"}, true},
+		{Rule{DDLAddColumn: "rename"}, false},
+		{Rule{DDLDropTable: "delete_docs"}, false},
+	}
+
+	for _, test := range tests {
+		rule := test.Rule
+		rule.Schema, rule.Table = "test", "test_river"
+		if err := rule.prepare(); (err == nil) != test.Valid {
+			t.Errorf("Rule: %+v, Expected valid: %v, but: was %v", test.Rule, test.Valid, err)
+		}
+	}
+}
+
+func newTestDDLRiver() *River {
+	r := newTestSnapshotRiver()
+	r.parser = parser.New()
+	return r
+}
+
+func execTestDDL(t *testing.T, r *River, pos uint32, query string) {
+	e := &replication.QueryEvent{Schema: []byte("test"), Query: []byte(query)}
+	if err := r.handleDDL(mysql.Position{Name: "mysql-bin.000001", Pos: pos}, e); err != nil {
+		t.Fatalf("handle DDL %s err %v", query, err)
+	}
+}
+
+func TestDDLRenameColumn(t *testing.T) {
+	r := newTestDDLRiver()
+
+	keep := r.rules[ruleKey("test", "test_river")]
+	keep.DDLRenameColumn = ddlKeepField
+	keep.Filter = []string{"id", "title"}
+
+	rename := r.rules[ruleKey("test", "test_river_0000")]
+	rename.DDLRenameColumn = ddlRenameField
+	rename.FieldMapping = map[string]string{"content": ",list"}
+
+	execTestDDL(t, r, 100, "ALTER TABLE test_river CHANGE title name VARCHAR(256)")
+	if !reflect.DeepEqual(keep.FieldMapping, map[string]string{"name": "title"}) {
+		t.Errorf("Expected field mapping name: title, but: was %v", keep.FieldMapping)
+	}
+	if !reflect.DeepEqual(keep.Filter, []string{"id", "name"}) {
+		t.Errorf("Expected filter [id name], but: was %v", keep.Filter)
+	}
+	if len(r.syncCh) != 0 {
+		t.Errorf("Expected no task for keep, but: was %d", len(r.syncCh))
+	}
+
+	execTestDDL(t, r, 200, "ALTER TABLE test.test_river_0000 CHANGE content body TEXT, CHANGE title name VARCHAR(256)")
+	if !reflect.DeepEqual(rename.FieldMapping, map[string]string{"body": ",list"}) {
+		t.Errorf("Expected field mapping body: ,list, but: was %v", rename.FieldMapping)
+	}
+	if len(r.syncCh) != 2 {
+		t.Errorf("Expected 2 update by query tasks, but: was %d", len(r.syncCh))
+	}
+
+	// the same DDL event is handled once
+	execTestDDL(t, r, 200, "ALTER TABLE test.test_river_0000 CHANGE content body TEXT, CHANGE title name VARCHAR(256)")
+	if len(r.syncCh) != 2 {
+		t.Errorf("Expected 2 update by query tasks, but: was %d", len(r.syncCh))
+	}
+
+	// ignored by default
+	other := r.rules[ruleKey("test", "test_river_0001")]
+	execTestDDL(t, r, 300, "ALTER TABLE test_river_0001 CHANGE title name VARCHAR(256)")
+	if len(other.FieldMapping) != 0 || len(r.syncCh) != 2 {
+		t.Errorf("Expected the DDL is ignored, but: field mapping was %v", other.FieldMapping)
+	}
+}
+
+func TestDDLDropTable(t *testing.T) {
+	r := newTestDDLRiver()
+
+	for _, rule := range r.rules {
+		rule.DDLDropTable = ddlDeleteIndex
+		rule.DDLTruncateTable = ddlDeleteDocs
+	}
+	r.rules[ruleKey("test", "test_river_0000")].Index = "shared"
+	r.rules[ruleKey("test", "test_river_0001")].Index = "shared"
+
+	execTestDDL(t, r, 100, "TRUNCATE TABLE test_river")
+	execTestDDL(t, r, 200, "TRUNCATE TABLE test_river_0000")
+	if len(r.syncCh) != 1 {
+		t.Errorf("Expected 1 delete by query task, but: was %d", len(r.syncCh))
+	}
+
+	execTestDDL(t, r, 300, "DROP TABLE test_river, test_river_0000")
+	if len(r.rules) != 1 {
+		t.Errorf("Expected 1 rule left, but: was %d", len(r.rules))
+	}
+	// the shared index is not deleted
+	if len(r.syncCh) != 2 {
+		t.Errorf("Expected 2 tasks, but: was %d", len(r.syncCh))
+	}
+}
+
+func TestDDLAddColumn(t *testing.T) {
+	r := newTestDDLRiver()
+
+	rule := r.rules[ruleKey("test", "test_river")]
+	rule.DDLAddColumn = ddlPutMapping
+	rule.TableInfo.AddColumn("price", "decimal(10,2)", "", "")
+
+	execTestDDL(t, r, 100, "ALTER TABLE test_river ADD COLUMN price DECIMAL(10,2)")
+	if len(r.syncCh) != 1 {
+		t.Errorf("Expected 1 put mapping task, but: was %d", len(r.syncCh))
+	}
+}
@@ -0,0 +1,256 @@
+package river
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go/ioutil2"
+)
+
+const deadLetterFileName = "dead_letter.jsonl"
+
+// deadLetter is a request rejected by ES, saved as one JSON line in the dead letter file.
+type deadLetter struct {
+	Time    time.Time            `json:"time"`
+	Status  int                  `json:"status"`
+	Error   json.RawMessage      `json:"error,omitempty"`
+	Request *elastic.BulkRequest `json:"request"`
+}
+
+// bulkItemError is a request failed in a bulk request.
+type bulkItemError struct {
+	req    *elastic.BulkRequest
+	status int
+	err    json.RawMessage
+}
+
+// isRetryableItemStatus checks whether the failed item can be sent again later, the items
+// not written because a split bulk request failed have the status of that request.
+func isRetryableItemStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// deadLetterQueue appends the requests which can't be synced into a file, so that
+// we can replay them after fixing the problem, e.g, the mapping conflict.
+type deadLetterQueue struct {
+	sync.Mutex
+
+	filePath string
+	f        *os.File
+}
+
+func openDeadLetterQueue(dataDir string) (*deadLetterQueue, error) {
+	if len(dataDir) == 0 {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	q := &deadLetterQueue{filePath: path.Join(dataDir, deadLetterFileName)}
+
+	var err error
+	q.f, err = os.OpenFile(q.filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return q, nil
+}
+
+// Put saves the failed items, the binlog position of every item is saved in its request.
+// If the queue is nil, which means no data dir, we can only log them.
+func (q *deadLetterQueue) Put(items []*bulkItemError) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	esDeadLetterNum.Add(float64(len(items)))
+
+	if q == nil {
+		for _, item := range items {
+			log.Errorf("drop %s index: %s, id: %s, status: %d, error: %s, no data dir for dead letter",
+				item.req.Action, item.req.Index, item.req.ID, item.status, item.err)
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	now := time.Now()
+	for _, item := range items {
+		l := deadLetter{
+			Time:    now,
+			Status:  item.status,
+			Error:   item.err,
+			Request: item.req,
+		}
+
+		data, err := json.Marshal(l)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	if _, err := q.f.Write(buf.Bytes()); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(q.f.Sync())
+}
+
+func (q *deadLetterQueue) Close() error {
+	if q == nil {
+		return nil
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	return q.f.Close()
+}
+
+func readDeadLetters(filePath string) ([]*deadLetter, error) {
+	f, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	var letters []*deadLetter
+	rb := bufio.NewReader(f)
+	for {
+		line, err := rb.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, errors.Trace(err)
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			l := new(deadLetter)
+			// keep the original number format, e.g, a big int64 must not become a float64
+			d := json.NewDecoder(bytes.NewReader(line))
+			d.UseNumber()
+			if err := d.Decode(l); err != nil {
+				return nil, errors.Annotatef(err, "invalid dead letter %s", line)
+			}
+			letters = append(letters, l)
+		}
+
+		if err == io.EOF {
+			return letters, nil
+		}
+	}
+}
+
+func writeDeadLetters(filePath string, letters []*deadLetter) error {
+	var buf bytes.Buffer
+	for _, l := range letters {
+		data, err := json.Marshal(l)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	return errors.Trace(ioutil2.WriteFileAtomic(filePath, buf.Bytes(), 0644))
+}
+
+// ReplayDeadLetter sends the requests in the dead letter file to ES again,
+// the requests still failed are kept in the file, except the stale ones with the external version.
+// The river must be stopped before replaying, otherwise the new dead letters may be lost.
+func ReplayDeadLetter(c *Config) error {
+	if len(c.DataDir) == 0 {
+		return errors.Errorf("data dir is not set, no dead letter to replay")
+	}
+
+	filePath := path.Join(c.DataDir, deadLetterFileName)
+	letters, err := readDeadLetters(filePath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(letters) == 0 {
+		log.Infof("no dead letter in %s", filePath)
+		return nil
+	}
+
+	es, err := newElasticClient(c)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer es.Close()
+
+	bulkSize := c.BulkSize
+	if bulkSize == 0 {
+		bulkSize = 128
+	}
+
+	failed := make([]*deadLetter, 0, len(letters))
+	for i := 0; i < len(letters); i += bulkSize {
+		batch := letters[i:]
+		if len(batch) > bulkSize {
+			batch = batch[:bulkSize]
+		}
+
+		reqs := make([]*elastic.BulkRequest, 0, len(batch))
+		for _, l := range batch {
+			reqs = append(reqs, l.Request)
+		}
+
+		resp, err := es.Bulk(reqs)
+		if err == nil && resp.Code/100 != 2 {
+			err = &bulkStatusError{resp.Code}
+		}
+		if err != nil {
+			// keep all the unsent letters and stop here
+			failed = append(failed, letters[i:]...)
+			if werr := writeDeadLetters(filePath, failed); werr != nil {
+				log.Errorf("save dead letters to %s err %v", filePath, werr)
+			}
+			return errors.Trace(err)
+		}
+
+		for j, l := range batch {
+			if j >= len(resp.Items) {
+				failed = append(failed, l)
+				continue
+			}
+			for _, item := range resp.Items[j] {
+				if item.Status == http.StatusConflict && l.Request.VersionType == elastic.VersionTypeExternal {
+					// a newer change is written after the letter, same as doBulk
+					log.Warnf("drop stale dead letter index: %s, id: %s, version: %d", l.Request.Index,
+						l.Request.ID, l.Request.Version)
+					continue
+				}
+				if len(item.Error) > 0 {
+					l.Time = time.Now()
+					l.Status = item.Status
+					l.Error = item.Error
+					failed = append(failed, l)
+				}
+			}
+		}
+	}
+
+	log.Infof("replay %d dead letters, %d succeeded, %d failed", len(letters), len(letters)-len(failed), len(failed))
+
+	return errors.Trace(writeDeadLetters(filePath, failed))
+}
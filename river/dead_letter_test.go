@@ -0,0 +1,134 @@
+package river
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+func TestDeadLetterQueue(t *testing.T) {
+	dataDir := "/tmp/test_river_dead_letter"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+
+	q, err := openDeadLetterQueue(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := []*bulkItemError{
+		{
+			req: &elastic.BulkRequest{Action: elastic.ActionIndex, Index: "river", ID: "1", Data: map[string]interface{}{"id": int64(9007199254740993)},
+				BinName: "mysql-bin.000001", BinPos: 4},
+			status: 400,
+			err:    json.RawMessage(`{"type":"mapper_parsing_exception"}`),
+		},
+		{
+			req:    &elastic.BulkRequest{Action: elastic.ActionDelete, Index: "river", ID: "2"},
+			status: 503,
+		},
+	}
+
+	if err = q.Put(items); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	letters, err := readDeadLetters(path.Join(dataDir, deadLetterFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(letters) != 2 {
+		t.Fatalf("Expected: 2 dead letters, but: was %d", len(letters))
+	}
+
+	l := letters[0]
+	if l.Request.BinName != "mysql-bin.000001" || l.Request.BinPos != 4 || l.Status != 400 {
+		t.Errorf("Unexpected dead letter %+v", l)
+	}
+	if v := l.Request.Data["id"]; v != json.Number("9007199254740993") {
+		t.Errorf("Expected: id is 9007199254740993, but: was %v", v)
+	}
+	if l = letters[1]; l.Request.Action != elastic.ActionDelete || l.Request.ID != "2" {
+		t.Errorf("Unexpected dead letter request %+v", l.Request)
+	}
+}
+
+func TestEventPosition(t *testing.T) {
+	r := newTestSnapshotRiver()
+	h := &eventHandler{r}
+	rule := r.rules[ruleKey("test", "test_river")]
+
+	if err := h.OnRotate(&replication.RotateEvent{Position: 4, NextLogName: []byte("mysql-bin.000002")}); err != nil {
+		t.Fatal(err)
+	}
+
+	insert := &canal.RowsEvent{
+		Table:  rule.TableInfo,
+		Action: canal.InsertAction,
+		Rows:   [][]interface{}{{int64(1), "a", "content"}},
+		Header: &replication.EventHeader{LogPos: 1234},
+	}
+	if err := h.OnRow(insert); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := (<-r.syncCh).([]*elastic.BulkRequest)
+	if reqs[0].BinName != "mysql-bin.000002" || reqs[0].BinPos != 1234 {
+		t.Errorf("Expected: position (mysql-bin.000002, 1234), but: was (%s, %d)", reqs[0].BinName, reqs[0].BinPos)
+	}
+}
+
+func TestReplayDeadLetter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"took":1,"errors":true,"items":[` +
+			`{"index":{"_index":"river","_id":"1","status":409,"error":{"type":"version_conflict_engine_exception"}}},` +
+			`{"index":{"_index":"river","_id":"2","status":400,"error":{"type":"mapper_parsing_exception"}}},` +
+			`{"index":{"_index":"river","_id":"3","status":201}}]}`))
+	}))
+	defer ts.Close()
+
+	dataDir := "/tmp/test_river_replay_dead_letter"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+
+	q, err := openDeadLetterQueue(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []*bulkItemError
+	for _, id := range []string{"1", "2", "3"} {
+		items = append(items, &bulkItemError{
+			req: &elastic.BulkRequest{Action: elastic.ActionIndex, Index: "river", ID: id, Data: map[string]interface{}{"id": id},
+				Version: 10, VersionType: elastic.VersionTypeExternal},
+			status: 503,
+		})
+	}
+	if err = q.Put(items); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	c := &Config{DataDir: dataDir, ESAddr: strings.TrimPrefix(ts.URL, "http://"), ESVersion: "7.0.0"}
+	if err = ReplayDeadLetter(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stale letter is dropped, only the rejected one is kept
+	letters, err := readDeadLetters(path.Join(dataDir, deadLetterFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Request.ID != "2" || letters[0].Status != 400 {
+		t.Errorf("Expected the dead letter of doc 2, but: was %+v", letters)
+	}
+}
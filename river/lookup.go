@@ -0,0 +1,512 @@
+package river
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// Lookup copies the columns of the row in another table into the docs of the rule,
+// the row is referenced by the foreign key column of the rule table.
+type Lookup struct {
+	Schema string `toml:"schema"`
+	Table  string `toml:"table"`
+	// Key is the column of the lookup table referenced by foreign_key, the primary key by default.
+	Key string `toml:"key"`
+	// ForeignKey is the column of the rule table, it needs an index, the rows referencing
+	// the changed lookup rows are read by it.
+	ForeignKey string `toml:"foreign_key"`
+	// Field maps the columns of the lookup table to the ES fields, e.g, name = "brand_name",
+	// the column name is used if the field is empty.
+	Field map[string]string `toml:"field"`
+
+	// MySQL table information of the lookup table
+	TableInfo *schema.Table
+
+	// the columns in field, sorted
+	columns []string
+}
+
+// lookupRef is the lookup of the rule which references the lookup table.
+type lookupRef struct {
+	rule *Rule
+	// the index in rule.Lookups, the lookup may be replaced by DDL
+	index int
+}
+
+func (l *Lookup) prepare(rule *Rule) error {
+	if len(l.Schema) == 0 {
+		l.Schema = rule.Schema
+	}
+
+	if len(l.Table) == 0 {
+		return errors.Errorf("rule %s.%s must have a table for lookup", rule.Schema, rule.Table)
+	}
+	if len(l.ForeignKey) == 0 {
+		return errors.Errorf("rule %s.%s must have a foreign_key for lookup %s.%s", rule.Schema, rule.Table,
+			l.Schema, l.Table)
+	}
+	if len(l.Field) == 0 {
+		return errors.Errorf("rule %s.%s must have the fields for lookup %s.%s", rule.Schema, rule.Table,
+			l.Schema, l.Table)
+	}
+
+	l.columns = make([]string, 0, len(l.Field))
+	for column, field := range l.Field {
+		if len(field) == 0 {
+			l.Field[column] = column
+		}
+		l.columns = append(l.columns, column)
+	}
+	sort.Strings(l.columns)
+
+	return nil
+}
+
+// prepareTable checks the columns of the lookup table, and uses the primary key if no key.
+func (l *Lookup) prepareTable(tableInfo *schema.Table) error {
+	if len(l.Key) == 0 {
+		if len(tableInfo.PKColumns) != 1 {
+			return errors.Errorf("lookup table %s.%s must have a key, or a primary key of one column",
+				l.Schema, l.Table)
+		}
+		l.Key = tableInfo.GetPKColumn(0).Name
+	}
+
+	for _, column := range append([]string{l.Key}, l.columns...) {
+		if tableInfo.FindColumn(column) < 0 {
+			return errors.Errorf("lookup column %s not found in %s.%s", column, l.Schema, l.Table)
+		}
+	}
+
+	l.TableInfo = tableInfo
+	return nil
+}
+
+// addLookupRefs checks the lookups of the rule, and records the lookup tables
+// so the docs are refreshed when the rows of the lookup tables are changed.
+func (r *River) addLookupRefs(rule *Rule) error {
+	for i, l := range rule.Lookups {
+		if rule.TableInfo.FindColumn(l.ForeignKey) < 0 {
+			return errors.Errorf("lookup foreign key column %s not found in %s.%s", l.ForeignKey,
+				rule.Schema, rule.Table)
+		}
+
+		// the lookup may be shared with other tables by the wildcard rule
+		if l.TableInfo == nil {
+			tableInfo, err := r.canal.GetTable(l.Schema, l.Table)
+			if err != nil {
+				return errors.Annotatef(err, "lookup table %s.%s", l.Schema, l.Table)
+			}
+			if err = l.prepareTable(tableInfo); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		key := ruleKey(l.Schema, l.Table)
+		r.lookups[key] = append(r.lookups[key], lookupRef{rule: rule, index: i})
+	}
+
+	return nil
+}
+
+// prepareLookups records the lookup tables of all the rules.
+func (r *River) prepareLookups() error {
+	r.lookups = make(map[string][]lookupRef)
+	for _, rule := range r.rules {
+		if err := r.addLookupRefs(rule); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// updateLookupTable updates the table information of the lookups after the lookup table is altered.
+func (r *River) updateLookupTable(schemaName string, table string) error {
+	refs := r.lookups[ruleKey(schemaName, table)]
+	if len(refs) == 0 {
+		return nil
+	}
+
+	tableInfo, err := r.canal.GetTable(schemaName, table)
+	if errors.Cause(err) == schema.ErrTableNotExist {
+		log.Warnf("lookup table %s.%s not exists, the lookups will fail", schemaName, table)
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+
+	r.rulesLock.Lock()
+	for _, ref := range refs {
+		ref.rule.Lookups[ref.index].TableInfo = tableInfo
+	}
+	r.rulesLock.Unlock()
+
+	return nil
+}
+
+// renameLookups returns the lookups with the foreign key renamed.
+func renameLookups(lookups []*Lookup, oldName string, newName string) []*Lookup {
+	if lookups == nil {
+		return nil
+	}
+
+	renamed := make([]*Lookup, len(lookups))
+	for i, l := range lookups {
+		if l.ForeignKey == oldName {
+			copied := *l
+			copied.ForeignKey = newName
+			l = &copied
+		}
+		renamed[i] = l
+	}
+	return renamed
+}
+
+// lookupQuery returns the query of the lookup rows with n keys, the key is the first column.
+func lookupQuery(l *Lookup, n int) string {
+	columns := make([]string, 0, len(l.columns)+1)
+	columns = append(columns, quoteName(l.Key))
+	for _, c := range l.columns {
+		columns = append(columns, quoteName(c))
+	}
+
+	marks := make([]string, n)
+	for i := range marks {
+		marks[i] = "?"
+	}
+
+	return fmt.Sprintf("SELECT %s FROM %s.%s WHERE %s IN (%s)", strings.Join(columns, ", "),
+		quoteName(l.Schema), quoteName(l.Table), quoteName(l.Key), strings.Join(marks, ", "))
+}
+
+// lookupKey formats the key for matching the lookup rows, the strings are []byte in the query result.
+func lookupKey(value interface{}) string {
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// lookupBatch collects the lookups of the docs made from the rows of an event or a chunk,
+// so the referenced rows are queried together, instead of one query for each row.
+type lookupBatch struct {
+	lookups []*Lookup
+	fills   map[*Lookup][]lookupFill
+}
+
+// lookupFill is the doc data which gets the fields of the lookup row referenced by value.
+type lookupFill struct {
+	data  map[string]interface{}
+	value interface{}
+}
+
+func (b *lookupBatch) add(data map[string]interface{}, l *Lookup, value interface{}) {
+	if b.fills == nil {
+		b.fills = make(map[*Lookup][]lookupFill)
+	}
+	if _, ok := b.fills[l]; !ok {
+		b.lookups = append(b.lookups, l)
+	}
+	b.fills[l] = append(b.fills[l], lookupFill{data: data, value: value})
+}
+
+// loadLookups queries the rows referenced by the batch, and sets the fields of the lookups in the docs.
+// The fields are null if the foreign key is null or the row is not found.
+func (r *River) loadLookups(b *lookupBatch) error {
+	for _, l := range b.lookups {
+		fills := b.fills[l]
+
+		var keys []interface{}
+		seen := make(map[string]struct{}, len(fills))
+		for _, f := range fills {
+			if f.value == nil {
+				continue
+			}
+			s := lookupKey(f.value)
+			if _, ok := seen[s]; !ok {
+				seen[s] = struct{}{}
+				keys = append(keys, f.value)
+			}
+		}
+
+		rows, err := r.queryLookupRows(l, keys)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, f := range fills {
+			var values []interface{}
+			if f.value != nil {
+				values = rows[lookupKey(f.value)]
+			}
+			r.setLookupFields(f.data, l, values)
+		}
+	}
+	return nil
+}
+
+// queryLookupRows returns the values of the lookup columns by the formatted keys,
+// the keys are queried in chunks of snapshot_chunk_size.
+func (r *River) queryLookupRows(l *Lookup, keys []interface{}) (map[string][]interface{}, error) {
+	rows := make(map[string][]interface{}, len(keys))
+	if len(keys) == 0 {
+		return rows, nil
+	}
+
+	chunkSize := r.c.SnapshotChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultSnapshotChunkSize
+	}
+
+	for start := 0; start < len(keys); start += chunkSize {
+		end := start + chunkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		rr, err := r.canal.Execute(lookupQuery(l, end-start), keys[start:end]...)
+		if err != nil {
+			return nil, errors.Annotatef(err, "look up %s.%s", l.Schema, l.Table)
+		}
+		for _, values := range rr.Values {
+			key := lookupKey(values[0])
+			// the key may be not unique, the first row is used
+			if _, ok := rows[key]; !ok {
+				rows[key] = values[1:]
+			}
+		}
+	}
+
+	return rows, nil
+}
+
+// setLookupFields sets the fields of the lookup with the values of the columns, or null if values is nil.
+func (r *River) setLookupFields(data map[string]interface{}, l *Lookup, values []interface{}) {
+	for i, column := range l.columns {
+		field := l.Field[column]
+		if values == nil {
+			data[field] = nil
+			continue
+		}
+
+		// the column may be dropped after the query
+		idx := l.TableInfo.FindColumn(column)
+		if idx < 0 {
+			data[field] = nil
+			continue
+		}
+
+		col := &l.TableInfo.Columns[idx]
+		data[field] = r.makeReqColumnData(col, snapshotValue(col, values[i]))
+	}
+}
+
+// makeRowLookupData adds all the lookups of the rule for the row to the batch.
+func (r *River) makeRowLookupData(data map[string]interface{}, rule *Rule, row []interface{}, lookups *lookupBatch) error {
+	for _, l := range rule.Lookups {
+		value, err := rule.TableInfo.GetColumnValue(l.ForeignKey, row)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		lookups.add(data, l, value)
+	}
+	return nil
+}
+
+// makeUpdateLookupData adds the lookups whose foreign key is changed to the batch.
+func (r *River) makeUpdateLookupData(data map[string]interface{}, rule *Rule, before []interface{}, after []interface{},
+	lookups *lookupBatch) error {
+	for _, l := range rule.Lookups {
+		beforeValue, err := rule.TableInfo.GetColumnValue(l.ForeignKey, before)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		afterValue, err := rule.TableInfo.GetColumnValue(l.ForeignKey, after)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if reflect.DeepEqual(beforeValue, afterValue) {
+			continue
+		}
+		lookups.add(data, l, afterValue)
+	}
+	return nil
+}
+
+// lookupChangedKeys returns the keys of the lookup rows whose lookup columns are changed.
+// The inserted rows are included, the rows referencing them may be synced before them
+// with the null lookup fields, e.g, without the foreign key constraint.
+func lookupChangedKeys(l *Lookup, table *schema.Table, action string, rows [][]interface{}) ([]interface{}, error) {
+	keyIdx := table.FindColumn(l.Key)
+	if keyIdx < 0 {
+		return nil, errors.Errorf("lookup column %s not found in %s.%s", l.Key, l.Schema, l.Table)
+	}
+
+	indexes := make([]int, 0, len(l.columns))
+	for _, column := range l.columns {
+		idx := table.FindColumn(column)
+		if idx < 0 {
+			return nil, errors.Errorf("lookup column %s not found in %s.%s", column, l.Schema, l.Table)
+		}
+		indexes = append(indexes, idx)
+	}
+
+	var keys []interface{}
+	seen := make(map[string]struct{})
+	add := func(key interface{}) {
+		if key == nil {
+			return
+		}
+		s := fmt.Sprintf("%v", key)
+		if _, ok := seen[s]; !ok {
+			seen[s] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+
+	switch action {
+	case canal.InsertAction, canal.DeleteAction:
+		for _, row := range rows {
+			add(row[keyIdx])
+		}
+	case canal.UpdateAction:
+		for i := 0; i+1 < len(rows); i += 2 {
+			before, after := rows[i], rows[i+1]
+			changed := !reflect.DeepEqual(before[keyIdx], after[keyIdx])
+			for _, idx := range indexes {
+				if !reflect.DeepEqual(before[idx], after[idx]) {
+					changed = true
+					break
+				}
+			}
+			if changed {
+				add(before[keyIdx])
+				add(after[keyIdx])
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// refreshLookup syncs the rows which reference the changed rows of the lookup table again,
+// so the docs have the new lookup fields. It runs in the canal goroutine.
+func (r *River) refreshLookup(e *canal.RowsEvent, version int64) error {
+	for _, ref := range r.lookups[ruleKey(e.Table.Schema, e.Table.Name)] {
+		// the rule may be dropped by DDL
+		if r.rules[ruleKey(ref.rule.Schema, ref.rule.Table)] != ref.rule {
+			continue
+		}
+
+		l := ref.rule.Lookups[ref.index]
+		keys, err := lookupChangedKeys(l, e.Table, e.Action, e.Rows)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		chunkSize := r.c.SnapshotChunkSize
+		if chunkSize <= 0 {
+			chunkSize = defaultSnapshotChunkSize
+		}
+
+		// the rows referencing a batch of keys are read together, so a bulk update
+		// of the lookup table doesn't run the chunk queries for every key
+		pos := r.eventPosition(e)
+		for start := 0; start < len(keys); start += chunkSize {
+			end := start + chunkSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			if err = r.refreshLookupRows(ref.rule, l, keys[start:end], version, pos); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// lookupRefCond returns the condition of the rows referencing n keys of the lookup table.
+func lookupRefCond(l *Lookup, n int) string {
+	marks := make([]string, n)
+	for i := range marks {
+		marks[i] = "?"
+	}
+	return fmt.Sprintf("%s IN (%s)", quoteName(l.ForeignKey), strings.Join(marks, ", "))
+}
+
+// refreshLookupRows reads the rows of the rule whose foreign key is in keys, chunk by chunk,
+// and indexes them again with the version and position of the lookup event.
+// The foreign key column needs an index, or each chunk scans the table.
+func (r *River) refreshLookupRows(rule *Rule, l *Lookup, keys []interface{}, version int64, pos mysql.Position) error {
+	chunkSize := r.c.SnapshotChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultSnapshotChunkSize
+	}
+
+	cond := lookupRefCond(l, len(keys))
+	rkey := ruleKey(rule.Schema, rule.Table)
+
+	var last []interface{}
+	var total int
+	for {
+		args := append(append(make([]interface{}, 0, len(keys)+len(last)), keys...), last...)
+		rr, err := r.canal.Execute(chunkQuery(rule.TableInfo, cond, last, chunkSize), args...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		rows := make([][]interface{}, 0, len(rr.Values))
+		for _, values := range rr.Values {
+			rows = append(rows, snapshotRow(rule.TableInfo, values))
+		}
+
+		reqs, err := r.makeInsertRequest(rule, rows)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		r.setVersion(reqs, version)
+		setPosition(reqs, pos)
+
+		r.windowLock.Lock()
+		if target, ok := r.reindexes[rkey]; ok {
+			reqs = append(reqs, reindexRequests(reqs, target)...)
+		}
+		if w := r.windows[rkey]; w != nil {
+			w.touch(reqs)
+		}
+		select {
+		case r.syncCh <- reqs:
+		case <-r.ctx.Done():
+		}
+		r.windowLock.Unlock()
+
+		if err = r.ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+
+		total += len(rows)
+		if len(rows) < chunkSize {
+			break
+		}
+
+		lastRow := rr.Values[len(rr.Values)-1]
+		last = make([]interface{}, len(rule.TableInfo.PKColumns))
+		for i, idx := range rule.TableInfo.PKColumns {
+			last[i] = lastRow[idx]
+		}
+	}
+
+	log.Infof("refresh %d rows of %s.%s referencing %d rows in %s.%s", total, rule.Schema, rule.Table,
+		len(keys), l.Schema, l.Table)
+	return nil
+}
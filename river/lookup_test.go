@@ -0,0 +1,158 @@
+package river
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func newTestLookupRule(t *testing.T) *Rule {
+	rule := &Rule{Schema: "test", Table: "products", Index: "products", Type: "_doc",
+		Lookups: []*Lookup{{Table: "brands", ForeignKey: "brand_id", Field: map[string]string{"name": "brand_name", "country": ""}}}}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "products"}
+	rule.TableInfo.AddColumn("id", "int(11)", "", "")
+	rule.TableInfo.AddColumn("title", "varchar(256)", "", "")
+	rule.TableInfo.AddColumn("brand_id", "int(11)", "", "")
+	rule.TableInfo.PKColumns = []int{0}
+
+	brands := &schema.Table{Schema: "test", Name: "brands"}
+	brands.AddColumn("id", "int(11)", "", "")
+	brands.AddColumn("name", "varchar(256)", "", "")
+	brands.AddColumn("country", "enum('cn','us')", "", "")
+	brands.PKColumns = []int{0}
+	if err := rule.Lookups[0].prepareTable(brands); err != nil {
+		t.Fatal(err)
+	}
+
+	return rule
+}
+
+func TestLookupPrepare(t *testing.T) {
+	rule := newTestLookupRule(t)
+	l := rule.Lookups[0]
+
+	if l.Schema != "test" || l.Key != "id" || l.Field["country"] != "country" {
+		t.Fatalf("Expected the default schema, key and field, but: was %+v", l)
+	}
+
+	if expect := "SELECT `id`, `country`, `name` FROM `test`.`brands` WHERE `id` IN (?, ?)"; lookupQuery(l, 2) != expect {
+		t.Errorf("Expected: %s, but: was %s", expect, lookupQuery(l, 2))
+	}
+
+	for _, l := range []*Lookup{
+		{ForeignKey: "brand_id", Field: map[string]string{"name": ""}},
+		{Table: "brands", Field: map[string]string{"name": ""}},
+		{Table: "brands", ForeignKey: "brand_id"},
+	} {
+		rule := &Rule{Schema: "test", Table: "products", Lookups: []*Lookup{l}}
+		if err := rule.prepare(); err == nil {
+			t.Errorf("Expected an error for lookup %+v", l)
+		}
+	}
+
+	l = &Lookup{Schema: "test", Table: "brands", ForeignKey: "brand_id", Field: map[string]string{"logo": ""}}
+	if err := l.prepare(rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.prepareTable(rule.Lookups[0].TableInfo); err == nil {
+		t.Errorf("Expected an error for the unknown column logo")
+	}
+}
+
+func TestLookupData(t *testing.T) {
+	r := new(River)
+	rule := newTestLookupRule(t)
+	l := rule.Lookups[0]
+
+	data := make(map[string]interface{})
+	r.setLookupFields(data, l, []interface{}{[]byte("us"), []byte("acme")})
+	if expect := map[string]interface{}{"brand_name": "acme", "country": "us"}; !reflect.DeepEqual(data, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, data)
+	}
+
+	// no brand, no query
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int64(1), "phone", nil}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{"id": int64(1), "title": "phone", "brand_id": nil, "brand_name": nil, "country": nil}
+	if !reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, reqs[0].Data)
+	}
+
+	// the inserted rows are looked up together
+	lookups := new(lookupBatch)
+	reqs, err = r.makeRequest(rule, canal.InsertAction, [][]interface{}{{int64(1), "phone", int64(2)}, {int64(2), "pad", int64(2)}}, lookups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fills := lookups.fills[l]; len(lookups.lookups) != 1 || len(fills) != 2 || fills[1].data["title"] != "pad" {
+		t.Errorf("Expected the lookup of 2 rows in the batch, but: was %+v", lookups)
+	}
+	if lookupKey([]byte("acme")) != lookupKey("acme") || lookupKey(uint64(2)) != lookupKey(int64(2)) {
+		t.Errorf("Expected the keys of the query result matching the row values")
+	}
+
+	// the brand is not changed, no query
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int64(1), "phone", int64(2)}, {int64(1), "pad", int64(2)}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := map[string]interface{}{"title": "pad"}; !reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, reqs[0].Data)
+	}
+}
+
+func TestLookupChangedKeys(t *testing.T) {
+	rule := newTestLookupRule(t)
+	l := rule.Lookups[0]
+
+	tests := []struct {
+		Action string
+		Rows   [][]interface{}
+		Expect []interface{}
+	}{
+		{canal.InsertAction, [][]interface{}{{int64(1), "acme", "us"}, {int64(1), "acme", "us"}}, []interface{}{int64(1)}},
+		{canal.DeleteAction, [][]interface{}{{int64(1), "acme", "us"}, {int64(2), "bolt", "cn"}}, []interface{}{int64(1), int64(2)}},
+		// the columns not looked up are changed
+		{canal.UpdateAction, [][]interface{}{{int64(1), "acme", "us", "a"}, {int64(1), "acme", "us", "b"}}, nil},
+		{canal.UpdateAction, [][]interface{}{{int64(1), "acme", "us"}, {int64(1), "Acme", "us"}}, []interface{}{int64(1)}},
+		{canal.UpdateAction, [][]interface{}{{int64(1), "acme", "us"}, {int64(3), "acme", "us"}}, []interface{}{int64(1), int64(3)}},
+	}
+
+	table := &schema.Table{Schema: "test", Name: "brands"}
+	table.AddColumn("id", "int(11)", "", "")
+	table.AddColumn("name", "varchar(256)", "", "")
+	table.AddColumn("country", "enum('cn','us')", "", "")
+	table.AddColumn("logo", "varchar(256)", "", "")
+
+	for _, test := range tests {
+		keys, err := lookupChangedKeys(l, table, test.Action, test.Rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, test.Expect) {
+			t.Errorf("%s %v Expected: %v, but: was %v", test.Action, test.Rows, test.Expect, keys)
+		}
+	}
+}
+
+func TestLookupParentQuery(t *testing.T) {
+	rule := newTestLookupRule(t)
+
+	expect := "SELECT `id`, `title`, `brand_id` FROM `test`.`products` WHERE `brand_id` IN (?, ?) AND `id` > ? ORDER BY `id` LIMIT 10"
+	if query := chunkQuery(rule.TableInfo, lookupRefCond(rule.Lookups[0], 2), []interface{}{1}, 10); query != expect {
+		t.Errorf("Expected: %s, but: was %s", expect, query)
+	}
+
+	renamed := renameLookups(rule.Lookups, "brand_id", "maker_id")
+	if renamed[0].ForeignKey != "maker_id" || rule.Lookups[0].ForeignKey != "brand_id" {
+		t.Errorf("Expected the copied lookup renamed, but: was %+v", renamed[0])
+	}
+}
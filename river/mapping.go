@@ -0,0 +1,175 @@
+package river
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// The max precision of the decimal which can be stored in a double without losing precision.
+const maxScaledFloatPrecision = 15
+
+var decimalTypeRegex = regexp.MustCompile(`^decimal\((\d+),(\d+)\)`)
+
+// esFieldName returns the ES field name and the field type in rule for the column,
+// the field name is empty if the column is not synced.
+func (r *River) esFieldName(rule *Rule, column string) (string, string) {
+	if !rule.CheckFilter(column) {
+		return "", ""
+	}
+
+	for k, v := range rule.FieldMapping {
+		mysql, elastic, fieldType := r.getFieldParts(k, v)
+		if mysql == column {
+			return elastic, fieldType
+		}
+	}
+
+	return column, ""
+}
+
+// esFieldMapping returns the ES mapping of the column, nil if we don't know how to map it.
+func esFieldMapping(col *schema.TableColumn, fieldType string) map[string]interface{} {
+	switch fieldType {
+	case fieldTypeList:
+		return map[string]interface{}{"type": "keyword"}
+	case fieldTypeDate:
+		return map[string]interface{}{"type": "date"}
+	}
+
+	switch col.Type {
+	case schema.TYPE_NUMBER, schema.TYPE_BIT:
+		if col.IsUnsigned && strings.HasPrefix(col.RawType, "bigint") {
+			// the value may overflow long, keep the exact value as a string
+			return map[string]interface{}{"type": "keyword"}
+		}
+		return map[string]interface{}{"type": "long"}
+	case schema.TYPE_FLOAT:
+		return map[string]interface{}{"type": "double"}
+	case schema.TYPE_DECIMAL:
+		m := decimalTypeRegex.FindStringSubmatch(col.RawType)
+		if m == nil {
+			return map[string]interface{}{"type": "double"}
+		}
+
+		precision, _ := strconv.Atoi(m[1])
+		scale, _ := strconv.Atoi(m[2])
+		if precision > maxScaledFloatPrecision {
+			// the values are synced as float64, the digits beyond the double precision are lost already
+			return map[string]interface{}{"type": "double"}
+		}
+
+		return map[string]interface{}{
+			"type":           "scaled_float",
+			"scaling_factor": math.Pow10(scale),
+		}
+	case schema.TYPE_ENUM, schema.TYPE_SET, schema.TYPE_TIME:
+		return map[string]interface{}{"type": "keyword"}
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_DATE:
+		return map[string]interface{}{"type": "date"}
+	case schema.TYPE_JSON:
+		return map[string]interface{}{"type": "object"}
+	case schema.TYPE_STRING:
+		if strings.Contains(col.RawType, "geometry") || strings.Contains(col.RawType, "point") ||
+			strings.Contains(col.RawType, "polygon") || strings.Contains(col.RawType, "linestring") {
+			return nil
+		}
+
+		return map[string]interface{}{
+			"type": "text",
+			"fields": map[string]interface{}{
+				"keyword": map[string]interface{}{
+					"type":         "keyword",
+					"ignore_above": 256,
+				},
+			},
+		}
+	}
+
+	return nil
+}
+
+// columnsMapping returns the ES mapping properties of the columns in rule.
+func (r *River) columnsMapping(rule *Rule, columns []string) map[string]interface{} {
+	properties := make(map[string]interface{}, len(columns))
+	for _, column := range columns {
+		idx := rule.TableInfo.FindColumn(column)
+		if idx < 0 {
+			continue
+		}
+
+		field, fieldType := r.esFieldName(rule, rule.TableInfo.Columns[idx].Name)
+		if len(field) == 0 {
+			continue
+		}
+
+		if m, ok := rule.Mapping[field]; ok {
+			properties[field] = m
+		} else if m := esFieldMapping(&rule.TableInfo.Columns[idx], fieldType); m != nil {
+			properties[field] = m
+		}
+	}
+	return properties
+}
+
+// ruleMapping returns the ES mapping of all the columns in rule, wrapped with the document type.
+func (r *River) ruleMapping(rule *Rule) map[string]interface{} {
+	columns := make([]string, 0, len(rule.TableInfo.Columns))
+	for _, c := range rule.TableInfo.Columns {
+		columns = append(columns, c.Name)
+	}
+
+	properties := r.columnsMapping(rule, columns)
+	for _, l := range rule.Lookups {
+		if l.TableInfo == nil {
+			continue
+		}
+		for _, column := range l.columns {
+			idx := l.TableInfo.FindColumn(column)
+			if idx < 0 {
+				continue
+			}
+			if m := esFieldMapping(&l.TableInfo.Columns[idx], ""); m != nil {
+				properties[l.Field[column]] = m
+			}
+		}
+	}
+	// the overridden fields may be not in the table, e.g, added by the pipeline
+	for field, m := range rule.Mapping {
+		properties[field] = m
+	}
+
+	return map[string]interface{}{
+		rule.Type: map[string]interface{}{
+			"properties": wrapNestedMapping(rule, properties),
+		},
+	}
+}
+
+// putRulesMapping puts the generated mapping of the rules with auto_mapping before syncing,
+// ES fails if the mapping conflicts with the existing one.
+func (r *River) putRulesMapping() error {
+	keys := make([]string, 0, len(r.rules))
+	for key, rule := range r.rules {
+		if rule.AutoMapping {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		rule := r.rules[key]
+		log.Infof("put mapping of table %s.%s to index %s", rule.Schema, rule.Table, rule.Index)
+		if err := r.es.CreateMapping(rule.Index, rule.Type, r.ruleMapping(rule)); err != nil {
+			return errors.Annotatef(err, "put mapping of table %s.%s", rule.Schema, rule.Table)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,286 @@
+package river
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+const (
+	// mappingCheckOff doesn't check the mapping, it is the default mode.
+	mappingCheckOff = "off"
+	// mappingCheckWarn logs the incompatible fields.
+	mappingCheckWarn = "warn"
+	// mappingCheckError refuses to start, or stops syncing after DDL, if there are incompatible fields.
+	mappingCheckError = "error"
+)
+
+var (
+	esIntegerTypes = []string{"long", "integer", "short", "byte", "unsigned_long"}
+	esFloatTypes   = []string{"double", "float", "half_float", "scaled_float"}
+	esStringTypes  = []string{"text", "keyword", "constant_keyword", "wildcard", "match_only_text",
+		"search_as_you_type", "completion"}
+	esDateTypes   = []string{"date", "date_nanos"}
+	esObjectTypes = []string{"object", "nested", "flattened"}
+)
+
+// MappingConflict is a synced column whose type is incompatible with the type of the ES field.
+type MappingConflict struct {
+	Schema     string
+	Table      string
+	Column     string
+	ColumnType string
+
+	Index     string
+	Field     string
+	FieldType string
+}
+
+func (c MappingConflict) String() string {
+	return fmt.Sprintf("column %s.%s.%s %s is incompatible with field %s %s in index %s",
+		c.Schema, c.Table, c.Column, c.ColumnType, c.Field, c.FieldType, c.Index)
+}
+
+// compatibleFieldTypes returns the ES field types which can store the values of the column,
+// nil if we don't know.
+func compatibleFieldTypes(col *schema.TableColumn, fieldType string) []string {
+	switch fieldType {
+	case fieldTypeList:
+		return esStringTypes
+	case fieldTypeDate:
+		return esDateTypes
+	}
+
+	var types [][]string
+	switch col.Type {
+	case schema.TYPE_NUMBER, schema.TYPE_BIT:
+		// ES date accepts the milliseconds since the epoch
+		types = [][]string{esIntegerTypes, esFloatTypes, esStringTypes, esDateTypes}
+	case schema.TYPE_FLOAT, schema.TYPE_DECIMAL:
+		types = [][]string{esFloatTypes, esStringTypes}
+	case schema.TYPE_ENUM, schema.TYPE_SET, schema.TYPE_TIME:
+		types = [][]string{esStringTypes}
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP, schema.TYPE_DATE:
+		types = [][]string{esDateTypes, esStringTypes}
+	case schema.TYPE_JSON:
+		types = [][]string{esObjectTypes}
+	case schema.TYPE_STRING:
+		if esFieldMapping(col, "") == nil {
+			// geometry
+			return nil
+		}
+		types = [][]string{esStringTypes}
+	default:
+		return nil
+	}
+
+	var compatible []string
+	for _, t := range types {
+		compatible = append(compatible, t...)
+	}
+	return compatible
+}
+
+type mappingCheckColumn struct {
+	column     *schema.TableColumn
+	field      string
+	compatible []string
+}
+
+// checkRuleMapping compares the synced columns of the rule with the existing ES fields.
+// The fields not in ES are ignored because they will be mapped dynamically.
+func (r *River) checkRuleMapping(rule *Rule) ([]MappingConflict, error) {
+	r.rulesLock.RLock()
+	schemaName, table, index, docType, nestedField := rule.Schema, rule.Table, rule.Index, rule.Type, rule.NestedField
+	columns := make([]mappingCheckColumn, 0, len(rule.TableInfo.Columns))
+	for i := range rule.TableInfo.Columns {
+		col := &rule.TableInfo.Columns[i]
+		field, fieldType := r.esFieldName(rule, col.Name)
+		if len(field) == 0 {
+			continue
+		}
+		if compatible := compatibleFieldTypes(col, fieldType); compatible != nil {
+			columns = append(columns, mappingCheckColumn{column: col, field: field, compatible: compatible})
+		}
+	}
+	r.rulesLock.RUnlock()
+
+	resp, err := r.es.GetMapping(index, docType)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if resp.Code == http.StatusNotFound {
+		return nil, nil
+	} else if resp.Code != http.StatusOK {
+		return nil, errors.Errorf("get mapping of index %s, Error: %s, code: %d", index, http.StatusText(resp.Code), resp.Code)
+	}
+
+	var conflicts []MappingConflict
+	// the index may be an alias
+	for name, im := range resp.Mapping {
+		for _, tm := range im.Mappings {
+			properties := tm.Properties
+			if len(nestedField) > 0 {
+				properties = tm.Properties[nestedField].Properties
+			}
+
+			for _, c := range columns {
+				fm, ok := properties[c.field]
+				if !ok {
+					continue
+				}
+
+				// the object field has no type
+				t := fm.Type
+				if len(t) == 0 {
+					t = "object"
+				}
+
+				if !containsString(c.compatible, t) {
+					conflicts = append(conflicts, MappingConflict{
+						Schema:     schemaName,
+						Table:      table,
+						Column:     c.column.Name,
+						ColumnType: c.column.RawType,
+						Index:      name,
+						Field:      nestedFieldName(nestedField, c.field),
+						FieldType:  t,
+					})
+				}
+			}
+		}
+	}
+
+	return conflicts, nil
+}
+
+func nestedFieldName(nestedField string, field string) string {
+	if len(nestedField) == 0 {
+		return field
+	}
+	return nestedField + "." + field
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMapping checks the mapping of all the rules.
+func (r *River) checkMapping() ([]MappingConflict, error) {
+	r.rulesLock.RLock()
+	keys := make([]string, 0, len(r.rules))
+	for key := range r.rules {
+		keys = append(keys, key)
+	}
+	r.rulesLock.RUnlock()
+	sort.Strings(keys)
+
+	var conflicts []MappingConflict
+	for _, key := range keys {
+		r.rulesLock.RLock()
+		rule, ok := r.rules[key]
+		r.rulesLock.RUnlock()
+		if !ok {
+			continue
+		}
+
+		c, err := r.checkRuleMapping(rule)
+		if err != nil {
+			return nil, errors.Annotatef(err, "check mapping of table %s.%s", rule.Schema, rule.Table)
+		}
+		conflicts = append(conflicts, c...)
+	}
+
+	return conflicts, nil
+}
+
+// reportMappingConflicts logs the conflicts by the mapping check mode,
+// it returns an error if there are conflicts in error mode.
+func (r *River) reportMappingConflicts(conflicts []MappingConflict) error {
+	for _, c := range conflicts {
+		if r.c.MappingCheck == mappingCheckError {
+			log.Errorf("mapping check: %s", c)
+		} else {
+			log.Warnf("mapping check: %s", c)
+		}
+	}
+
+	if len(conflicts) > 0 && r.c.MappingCheck == mappingCheckError {
+		return errors.Errorf("%d incompatible mapping fields found", len(conflicts))
+	}
+	return nil
+}
+
+func (r *River) mappingCheckEnabled() bool {
+	return r.c.MappingCheck == mappingCheckWarn || r.c.MappingCheck == mappingCheckError
+}
+
+// checkStartupMapping checks the mapping of all the rules before syncing.
+func (r *River) checkStartupMapping() error {
+	if !r.mappingCheckEnabled() {
+		return nil
+	}
+
+	conflicts, err := r.checkMapping()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(conflicts) == 0 {
+		log.Infof("mapping check OK")
+	}
+	return errors.Trace(r.reportMappingConflicts(conflicts))
+}
+
+// checkDDLMapping checks the mapping of the altered table in the sync loop,
+// after the mapping changes of the DDL are applied.
+func (r *River) checkDDLMapping(rule *Rule) error {
+	if !r.mappingCheckEnabled() {
+		return nil
+	}
+
+	return r.sendTask(func() error {
+		conflicts, err := r.checkRuleMapping(rule)
+		if err != nil {
+			// ES may be unavailable now, we don't stop syncing for it
+			log.Errorf("check mapping of table %s.%s err %v", rule.Schema, rule.Table, err)
+			return nil
+		}
+		return errors.Trace(r.reportMappingConflicts(conflicts))
+	})
+}
+
+// CheckMapping compares the columns of the tables in rules with the existing ES fields once,
+// and returns the incompatible ones.
+func CheckMapping(c *Config) ([]MappingConflict, error) {
+	r := new(River)
+	r.c = c
+	r.rules = make(map[string]*Rule)
+
+	var err error
+	if r.es, err = newElasticClient(c); err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.es.Close()
+
+	if err = r.newCanal(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer r.canal.Close()
+
+	if err = r.prepareRule(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return r.checkMapping()
+}
@@ -0,0 +1,58 @@
+package river
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+func TestCheckMapping(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/test_river/") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"root_cause":[{"type":"index_not_found_exception","reason":"no such index [test_river_0000]"}],` +
+				`"type":"index_not_found_exception","reason":"no such index [test_river_0000]"},"status":404}`))
+			return
+		}
+
+		w.Write([]byte(`{"test_river_v1": {"mappings": {"properties": {
+			"id": {"type": "keyword"},
+			"title": {"type": "long"},
+			"content": {"properties": {"body": {"type": "text"}}}
+		}}}}`))
+	}))
+	defer ts.Close()
+
+	r := newTestSnapshotRiver()
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://"), Version: "7.0.0"})
+	defer r.es.Close()
+
+	conflicts, err := r.checkMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conflicts) != 2 {
+		t.Fatalf("Expected 2 conflicts, but: was %v", conflicts)
+	}
+
+	if c := conflicts[0]; c.Column != "title" || c.Index != "test_river_v1" || c.FieldType != "long" {
+		t.Errorf("Expected title conflicts with long, but: was %s", c)
+	}
+	if c := conflicts[1]; c.Column != "content" || c.FieldType != "object" {
+		t.Errorf("Expected content conflicts with object, but: was %s", c)
+	}
+
+	r.c.MappingCheck = mappingCheckWarn
+	if err = r.reportMappingConflicts(conflicts); err != nil {
+		t.Errorf("Expected no error in warn mode, but: was %v", err)
+	}
+
+	r.c.MappingCheck = mappingCheckError
+	if err = r.reportMappingConflicts(conflicts); err == nil {
+		t.Errorf("Expected error in error mode")
+	}
+}
@@ -0,0 +1,93 @@
+package river
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func TestESFieldMapping(t *testing.T) {
+	table := &schema.Table{Schema: "test", Name: "test_river"}
+	table.AddColumn("id", "int(11)", "", "")
+	table.AddColumn("price", "decimal(10,2)", "", "")
+	table.AddColumn("amount", "decimal(30,10)", "", "")
+	table.AddColumn("created", "datetime", "", "")
+	table.AddColumn("tags", "varchar(256)", "", "")
+	table.AddColumn("counter", "bigint(20) unsigned", "", "")
+
+	tests := []struct {
+		Column    int
+		FieldType string
+		Expect    string
+	}{
+		{0, "", "long"},
+		{1, "", "scaled_float"},
+		{2, "", "double"},
+		{3, "", "date"},
+		{4, "", "text"},
+		{4, fieldTypeList, "keyword"},
+		{5, "", "keyword"},
+	}
+
+	for _, test := range tests {
+		m := esFieldMapping(&table.Columns[test.Column], test.FieldType)
+		if m["type"] != test.Expect {
+			t.Errorf("Column: %s, Expected: %s, but: was %v", table.Columns[test.Column].Name, test.Expect, m["type"])
+		}
+	}
+}
+
+func TestRuleMapping(t *testing.T) {
+	str := `
+[[rule]]
+schema = "test"
+table = "test_river"
+index = "river"
+type = "river"
+auto_mapping = true
+filter = ["id", "title", "tags", "price"]
+
+[rule.field]
+title = "es_title"
+tags = ",list"
+
+[rule.mapping]
+es_title = { type = "text", analyzer = "ik_max_word" }
+location = { type = "geo_point" }
+`
+
+	var c Config
+	if _, err := toml.Decode(str, &c); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := c.Rules[0]
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "test_river"}
+	rule.TableInfo.AddColumn("id", "int(11)", "", "")
+	rule.TableInfo.AddColumn("title", "varchar(256)", "", "")
+	rule.TableInfo.AddColumn("tags", "varchar(256)", "", "")
+	rule.TableInfo.AddColumn("price", "decimal(10,2)", "", "")
+	rule.TableInfo.AddColumn("content", "text", "", "")
+
+	r := new(River)
+	mapping := r.ruleMapping(rule)
+
+	properties := mapping["river"].(map[string]interface{})["properties"].(map[string]interface{})
+	expected := map[string]interface{}{
+		"id":       map[string]interface{}{"type": "long"},
+		"es_title": map[string]interface{}{"type": "text", "analyzer": "ik_max_word"},
+		"tags":     map[string]interface{}{"type": "keyword"},
+		"price":    map[string]interface{}{"type": "scaled_float", "scaling_factor": float64(100)},
+		"location": map[string]interface{}{"type": "geo_point"},
+	}
+
+	if !reflect.DeepEqual(properties, expected) {
+		t.Errorf("Expected: %v, but: was %v", expected, properties)
+	}
+}
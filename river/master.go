@@ -1,82 +1,149 @@
 package river
 
 import (
-	"bytes"
-	"os"
-	"path"
 	"sync"
 	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/juju/errors"
 	"github.com/siddontang/go-log/log"
 	"github.com/siddontang/go-mysql/mysql"
-	"github.com/siddontang/go/ioutil2"
+)
+
+const (
+	// checkpointModePosition saves the binlog file name and position, it is the default mode.
+	checkpointModePosition = "position"
+	// checkpointModeGTID saves the executed GTID set too, and resumes syncing with it,
+	// so we can fail over to another MySQL whose binlog file and position are different.
+	checkpointModeGTID = "gtid"
 )
 
 type masterInfo struct {
 	sync.RWMutex
 
-	Name string `toml:"bin_name"`
-	Pos  uint32 `toml:"bin_pos"`
+	SyncPosition
 
-	filePath     string
+	store        PositionStore
 	lastSaveTime time.Time
 }
 
-func loadMasterInfo(dataDir string) (*masterInfo, error) {
-	var m masterInfo
+// loadMasterInfo loads the saved position from the store,
+// if store is nil, the position is only kept in memory.
+func loadMasterInfo(store PositionStore) (*masterInfo, error) {
+	m := &masterInfo{store: store}
 
-	if len(dataDir) == 0 {
-		return &m, nil
+	if store == nil {
+		return m, nil
 	}
 
-	m.filePath = path.Join(dataDir, "master.info")
 	m.lastSaveTime = time.Now()
 
-	if err := os.MkdirAll(dataDir, 0755); err != nil {
+	pos, err := store.Load()
+	if err != nil {
 		return nil, errors.Trace(err)
+	} else if pos != nil {
+		m.SyncPosition = *pos
 	}
 
-	f, err := os.Open(m.filePath)
-	if err != nil && !os.IsNotExist(errors.Cause(err)) {
-		return nil, errors.Trace(err)
-	} else if os.IsNotExist(errors.Cause(err)) {
-		return &m, nil
+	return m, nil
+}
+
+// Save saves the binlog position and the executed GTID set,
+// the saved GTID set will not be changed if gset is nil or empty.
+func (m *masterInfo) Save(pos mysql.Position, gset mysql.GTIDSet) error {
+	if gset != nil && len(gset.String()) > 0 {
+		log.Infof("save position %s, GTID set %s", pos, gset)
+	} else {
+		log.Infof("save position %s", pos)
 	}
-	defer f.Close()
 
-	_, err = toml.DecodeReader(f, &m)
-	return &m, errors.Trace(err)
-}
+	m.Lock()
+	defer m.Unlock()
+
+	m.Name = pos.Name
+	m.Pos = pos.Pos
+	if gset != nil && len(gset.String()) > 0 {
+		m.GTID = gset.String()
+	}
 
-func (m *masterInfo) Save(pos mysql.Position) error {
-	log.Infof("save position %s", pos)
+	return m.save(false)
+}
 
+// StartSnapshot saves the binlog position and GTID set of the native snapshot,
+// and the snapshot progress of the tables.
+func (m *masterInfo) StartSnapshot(pos mysql.Position, gset mysql.GTIDSet, keys []string) error {
 	m.Lock()
 	defer m.Unlock()
 
 	m.Name = pos.Name
 	m.Pos = pos.Pos
+	if gset != nil {
+		m.GTID = gset.String()
+	}
+
+	m.Snapshot = make(map[string]string, len(keys))
+	for _, key := range keys {
+		m.Snapshot[key] = ""
+	}
+
+	return m.save(true)
+}
+
+// SaveSnapshot saves the snapshot progress of the table with rule key.
+func (m *masterInfo) SaveSnapshot(key string, progress string, force bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.Snapshot == nil {
+		m.Snapshot = make(map[string]string)
+	}
+	m.Snapshot[key] = progress
+
+	return m.save(force)
+}
 
-	if len(m.filePath) == 0 {
+// FinishSnapshot clears the snapshot progress after all the tables are copied.
+func (m *masterInfo) FinishSnapshot() error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.Snapshot = nil
+
+	return m.save(true)
+}
+
+// SnapshotProgress returns the progress of the unfinished snapshot, nil if no snapshot is running.
+func (m *masterInfo) SnapshotProgress() map[string]string {
+	m.RLock()
+	defer m.RUnlock()
+
+	if m.Snapshot == nil {
+		return nil
+	}
+
+	progress := make(map[string]string, len(m.Snapshot))
+	for k, v := range m.Snapshot {
+		progress[k] = v
+	}
+	return progress
+}
+
+// save saves the sync position to the store, at most once per second unless force.
+// It must be called with the lock held.
+func (m *masterInfo) save(force bool) error {
+	if m.store == nil {
 		return nil
 	}
 
 	n := time.Now()
-	if n.Sub(m.lastSaveTime) < time.Second {
+	if !force && n.Sub(m.lastSaveTime) < time.Second {
 		return nil
 	}
 
 	m.lastSaveTime = n
-	var buf bytes.Buffer
-	e := toml.NewEncoder(&buf)
-
-	e.Encode(m)
 
 	var err error
-	if err = ioutil2.WriteFileAtomic(m.filePath, buf.Bytes(), 0644); err != nil {
-		log.Errorf("canal save master info to file %s err %v", m.filePath, err)
+	if err = m.store.Save(&m.SyncPosition); err != nil {
+		log.Errorf("save master info to %s err %v", m.store, err)
 	}
 
 	return errors.Trace(err)
@@ -92,8 +159,23 @@ func (m *masterInfo) Position() mysql.Position {
 	}
 }
 
+// GTIDSet returns the saved GTID set, empty if we have not synced with GTID yet.
+func (m *masterInfo) GTIDSet() string {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.GTID
+}
+
 func (m *masterInfo) Close() error {
-	pos := m.Position()
+	// always save the last position when closing
+	m.Lock()
+	err := m.save(true)
+	m.Unlock()
+
+	if m.store != nil {
+		m.store.Close()
+	}
 
-	return m.Save(pos)
+	return err
 }
@@ -1,12 +1,10 @@
 package river
 
 import (
-	"net/http"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -28,6 +26,24 @@ var (
 			Help: "The number of docs deleted from elasticsearch",
 		}, []string{"index"},
 	)
+	esStaleNum = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mysql2es_stale_num",
+			Help: "The number of stale writes rejected by elasticsearch with the external version",
+		}, []string{"index"},
+	)
+	esBulkRetryNum = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mysql2es_bulk_retry_num",
+			Help: "The number of retried bulk requests to elasticsearch",
+		},
+	)
+	esDeadLetterNum = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mysql2es_dead_letter_num",
+			Help: "The number of docs rejected by elasticsearch and put into the dead letter queue",
+		},
+	)
 	canalSyncState = promauto.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "mysql2es_canal_state",
@@ -47,8 +63,3 @@ func (r *River) collectMetrics() {
 		canalDelay.Set(float64(r.canal.GetDelay()))
 	}
 }
-
-func InitStatus(addr string, path string) {
-	http.Handle(path, promhttp.Handler())
-	http.ListenAndServe(addr, nil)
-}
@@ -0,0 +1,182 @@
+package river
+
+import (
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+// defaultNestedKey is the field in the nested element to store the doc id of the child row.
+const defaultNestedKey = "_key"
+
+// nestedScript adds, replaces or removes the element with the key in the nested field.
+// The element is removed if params.item is null, and the parent doc is not created for it.
+const nestedScript = `def items = ctx._source[params.field];
+if (items == null && params.item == null) {
+  ctx.op = 'none';
+} else {
+  if (items == null) {
+    items = new ArrayList();
+    ctx._source[params.field] = items;
+  }
+  items.removeIf(item -> item[params.key_field] == params.key);
+  if (params.item != null) {
+    items.add(params.item);
+  }
+}`
+
+// isNested checks whether the rows of the rule are embedded in the parent docs.
+func (r *Rule) isNested() bool {
+	return len(r.NestedField) > 0
+}
+
+// hasNestedChildren checks whether the docs in the index of rule have the nested fields
+// synced by other rules, so they must not be overwritten when indexing the parent row.
+func (r *River) hasNestedChildren(rule *Rule) bool {
+	_, ok := r.nestedIndices[rule.Index]
+	return ok && !rule.isNested()
+}
+
+// getNestedParentID returns the id of the parent doc of the child row.
+func (r *River) getNestedParentID(rule *Rule, row []interface{}) (string, error) {
+	ids := make([]interface{}, 0, len(rule.NestedParentID))
+	for _, column := range rule.NestedParentID {
+		value, err := rule.TableInfo.GetColumnValue(column, row)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		ids = append(ids, value)
+	}
+
+	return formatDocID(ids)
+}
+
+// getRowDocID returns the id of the doc which the row is synced to.
+func (r *River) getRowDocID(rule *Rule, row []interface{}) (string, error) {
+	if rule.isNested() {
+		return r.getNestedParentID(rule, row)
+	}
+	return r.getDocID(rule, row)
+}
+
+// makeNestedRequest updates the element of the child row in the nested field of the parent doc,
+// the element is removed if remove is true. The lookups of the element are added to the batch.
+func (r *River) makeNestedRequest(rule *Rule, row []interface{}, remove bool, lookups *lookupBatch) (*elastic.BulkRequest, error) {
+	parentID, err := r.getNestedParentID(rule, row)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	key, err := r.getDocID(rule, row)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// null to remove the element
+	var item interface{}
+	if !remove {
+		req := new(elastic.BulkRequest)
+		if err = r.makeInsertReqData(req, rule, row, lookups); err != nil {
+			return nil, errors.Trace(err)
+		}
+		req.Data[rule.NestedKey] = key
+		item = req.Data
+	}
+
+	esUpdateNum.WithLabelValues(rule.Index).Inc()
+
+	return &elastic.BulkRequest{
+		Action: elastic.ActionUpdate,
+		Index:  rule.Index,
+		Type:   rule.Type,
+		ID:     parentID,
+		Script: map[string]interface{}{
+			"source": nestedScript,
+			"lang":   "painless",
+			"params": map[string]interface{}{
+				"field":     rule.NestedField,
+				"key_field": rule.NestedKey,
+				"key":       key,
+				"item":      item,
+			},
+		},
+		ScriptedUpsert: true,
+	}, nil
+}
+
+// makeNestedUpdateRequest moves the element to the new parent doc if the parent or the key is changed,
+// otherwise replaces it.
+func (r *River) makeNestedUpdateRequest(rule *Rule, before []interface{}, after []interface{},
+	lookups *lookupBatch) ([]*elastic.BulkRequest, error) {
+	beforeParentID, err := r.getNestedParentID(rule, before)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	afterParentID, err := r.getNestedParentID(rule, after)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	beforeKey, err := r.getDocID(rule, before)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	afterKey, err := r.getDocID(rule, after)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	reqs := make([]*elastic.BulkRequest, 0, 2)
+	if beforeParentID != afterParentID || beforeKey != afterKey {
+		req, err := r.makeNestedRequest(rule, before, true, nil)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		reqs = append(reqs, req)
+	}
+
+	req, err := r.makeNestedRequest(rule, after, false, lookups)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return append(reqs, req), nil
+}
+
+// prepareNested checks the nested rules and records the indices which have the nested fields.
+func (r *River) prepareNested() error {
+	r.nestedIndices = make(map[string]struct{})
+	for _, rule := range r.rules {
+		if !rule.isNested() {
+			continue
+		}
+
+		for _, column := range rule.NestedParentID {
+			if rule.TableInfo.FindColumn(column) < 0 {
+				return errors.Errorf("nested parent id column %s not found in %s.%s", column, rule.Schema, rule.Table)
+			}
+		}
+		r.nestedIndices[rule.Index] = struct{}{}
+	}
+
+	for _, rule := range r.rules {
+		if r.hasNestedChildren(rule) && len(rule.Pipeline) > 0 {
+			return errors.Errorf("rule %s.%s can't use pipeline, because index %s has nested fields",
+				rule.Schema, rule.Table, rule.Index)
+		}
+	}
+
+	return nil
+}
+
+// wrapNestedMapping puts the properties of the child columns into the nested field.
+func wrapNestedMapping(rule *Rule, properties map[string]interface{}) map[string]interface{} {
+	if !rule.isNested() {
+		return properties
+	}
+
+	properties[rule.NestedKey] = map[string]interface{}{"type": "keyword"}
+	return map[string]interface{}{
+		rule.NestedField: map[string]interface{}{
+			"type":       "nested",
+			"properties": properties,
+		},
+	}
+}
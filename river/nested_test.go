@@ -0,0 +1,128 @@
+package river
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func newTestNestedRiver(t *testing.T) (*River, *Rule, *Rule) {
+	r := newTestSnapshotRiver()
+	r.rules = make(map[string]*Rule)
+
+	order := &Rule{Schema: "test", Table: "orders", Index: "orders", Type: "_doc"}
+	item := &Rule{Schema: "test", Table: "order_items", Index: "orders", Type: "_doc",
+		NestedField: "items", NestedParentID: []string{"order_id"}, Exclude: []string{"order_id"}}
+	for _, rule := range []*Rule{order, item} {
+		if err := rule.prepare(); err != nil {
+			t.Fatal(err)
+		}
+		r.rules[ruleKey(rule.Schema, rule.Table)] = rule
+	}
+
+	order.TableInfo = &schema.Table{Schema: "test", Name: "orders"}
+	order.TableInfo.AddColumn("id", "int(11)", "", "")
+	order.TableInfo.AddColumn("user", "varchar(256)", "", "")
+	order.TableInfo.PKColumns = []int{0}
+
+	item.TableInfo = &schema.Table{Schema: "test", Name: "order_items"}
+	item.TableInfo.AddColumn("id", "int(11)", "", "")
+	item.TableInfo.AddColumn("order_id", "int(11)", "", "")
+	item.TableInfo.AddColumn("sku", "varchar(256)", "", "")
+	item.TableInfo.PKColumns = []int{0}
+
+	if err := r.prepareNested(); err != nil {
+		t.Fatal(err)
+	}
+
+	return r, order, item
+}
+
+func nestedParams(req *elastic.BulkRequest) map[string]interface{} {
+	return req.Script["params"].(map[string]interface{})
+}
+
+func TestNestedRequest(t *testing.T) {
+	r, order, item := newTestNestedRiver(t)
+
+	reqs, err := r.makeInsertRequest(item, [][]interface{}{{int64(10), int64(1), "apple"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].Action != elastic.ActionUpdate || reqs[0].ID != "1" || !reqs[0].ScriptedUpsert {
+		t.Fatalf("Expected the script update of parent 1, but: was %+v", reqs)
+	}
+
+	params := nestedParams(reqs[0])
+	element := params["item"].(map[string]interface{})
+	if params["field"] != "items" || params["key"] != "10" || element["_key"] != "10" ||
+		element["sku"] != "apple" || element["order_id"] != nil {
+		t.Errorf("Unexpected params %v", params)
+	}
+
+	reqs, err = r.makeDeleteRequest(item, [][]interface{}{{int64(10), int64(1), "apple"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params = nestedParams(reqs[0]); len(reqs) != 1 || params["item"] != nil {
+		t.Errorf("Expected the element is removed, but: was %v", params)
+	}
+
+	// move the item to another order
+	reqs, err = r.makeUpdateRequest(item, [][]interface{}{{int64(10), int64(1), "apple"}, {int64(10), int64(2), "apple"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 || reqs[0].ID != "1" || nestedParams(reqs[0])["item"] != nil ||
+		reqs[1].ID != "2" || nestedParams(reqs[1])["item"] == nil {
+		t.Errorf("Expected the element is moved from 1 to 2, but: was %+v", reqs)
+	}
+
+	reqs, err = r.makeUpdateRequest(item, [][]interface{}{{int64(10), int64(1), "apple"}, {int64(10), int64(1), "pear"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || nestedParams(reqs[0])["item"].(map[string]interface{})["sku"] != "pear" {
+		t.Errorf("Expected the element is replaced, but: was %+v", reqs)
+	}
+
+	// the parent doc is updated, so the nested field is kept
+	reqs, err = r.makeInsertRequest(order, [][]interface{}{{int64(1), "bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].Action != elastic.ActionUpdate || !reqs[0].DocAsUpsert {
+		t.Errorf("Expected the parent doc is upserted, but: was %+v", reqs)
+	}
+
+	if !r.isIndexShared(item) {
+		t.Errorf("Expected the index of the nested rule is shared")
+	}
+
+	order.Pipeline = "p"
+	if err = r.prepareNested(); err == nil {
+		t.Errorf("Expected pipeline error")
+	}
+
+	rule := &Rule{Schema: "test", Table: "order_items", NestedField: "items"}
+	if err = rule.prepare(); err == nil {
+		t.Errorf("Expected nested_parent_id error")
+	}
+}
+
+func TestNestedMapping(t *testing.T) {
+	r, _, item := newTestNestedRiver(t)
+
+	mapping := r.ruleMapping(item)
+	properties := mapping["_doc"].(map[string]interface{})["properties"].(map[string]interface{})
+	items := properties["items"].(map[string]interface{})
+	if items["type"] != "nested" {
+		t.Fatalf("Expected nested type, but: was %v", items["type"])
+	}
+
+	fields := items["properties"].(map[string]interface{})
+	if _, ok := fields["order_id"]; ok || fields["sku"] == nil || fields["_key"] == nil || len(fields) != 3 {
+		t.Errorf("Unexpected nested properties %v", fields)
+	}
+}
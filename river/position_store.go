@@ -0,0 +1,108 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/BurntSushi/toml"
+	"github.com/juju/errors"
+	"github.com/siddontang/go/ioutil2"
+)
+
+const (
+	positionStoreFile          = "file"
+	positionStoreMySQL         = "mysql"
+	positionStoreElasticsearch = "elasticsearch"
+)
+
+// SyncPosition is the sync progress which can be used to resume syncing after restarting.
+type SyncPosition struct {
+	Name string `toml:"bin_name" json:"bin_name"`
+	Pos  uint32 `toml:"bin_pos" json:"bin_pos"`
+	GTID string `toml:"bin_gtid" json:"bin_gtid"`
+
+	// Snapshot is the progress of the native snapshot which is not finished yet, the key is
+	// the rule key, and the value is the last primary key copied in JSON, or done.
+	Snapshot map[string]string `toml:"snapshot,omitempty" json:"snapshot,omitempty"`
+}
+
+// PositionStore is the storage to save the sync position.
+type PositionStore interface {
+	// Load returns the saved position, or nil if not saved before.
+	Load() (*SyncPosition, error)
+	Save(pos *SyncPosition) error
+	Close() error
+	String() string
+}
+
+// newPositionStore creates the position store in config,
+// returns nil if we use the file store but no data dir.
+func newPositionStore(c *Config) (PositionStore, error) {
+	key := c.PositionKey
+	if len(key) == 0 {
+		key = fmt.Sprintf("%d", c.ServerID)
+	}
+
+	switch c.PositionStore {
+	case "", positionStoreFile:
+		if len(c.DataDir) == 0 {
+			return nil, nil
+		}
+		return newFilePositionStore(c.DataDir)
+	case positionStoreMySQL:
+		return newMySQLPositionStore(c, key)
+	case positionStoreElasticsearch:
+		return newESPositionStore(c, key)
+	default:
+		return nil, errors.Errorf("invalid position store %s, must be %s, %s or %s", c.PositionStore,
+			positionStoreFile, positionStoreMySQL, positionStoreElasticsearch)
+	}
+}
+
+// filePositionStore saves the position in the master.info file with TOML format.
+type filePositionStore struct {
+	filePath string
+}
+
+func newFilePositionStore(dataDir string) (*filePositionStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &filePositionStore{filePath: path.Join(dataDir, "master.info")}, nil
+}
+
+func (s *filePositionStore) Load() (*SyncPosition, error) {
+	f, err := os.Open(s.filePath)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Trace(err)
+	} else if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	}
+	defer f.Close()
+
+	var pos SyncPosition
+	_, err = toml.DecodeReader(f, &pos)
+	return &pos, errors.Trace(err)
+}
+
+func (s *filePositionStore) Save(pos *SyncPosition) error {
+	var buf bytes.Buffer
+	e := toml.NewEncoder(&buf)
+
+	if err := e.Encode(pos); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(ioutil2.WriteFileAtomic(s.filePath, buf.Bytes(), 0644))
+}
+
+func (s *filePositionStore) Close() error {
+	return nil
+}
+
+func (s *filePositionStore) String() string {
+	return fmt.Sprintf("file %s", s.filePath)
+}
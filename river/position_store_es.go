@@ -0,0 +1,86 @@
+package river
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+const (
+	defaultPositionIndex = "go_mysql_elasticsearch"
+	positionDocType      = "_doc"
+)
+
+// esPositionStore saves the position as a document in Elasticsearch, the document id is key.
+type esPositionStore struct {
+	es    *elastic.Client
+	index string
+	key   string
+}
+
+func newESPositionStore(c *Config, key string) (*esPositionStore, error) {
+	es, err := newElasticClient(c)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	s := &esPositionStore{
+		es:    es,
+		index: c.PositionIndex,
+		key:   key,
+	}
+
+	if len(s.index) == 0 {
+		s.index = defaultPositionIndex
+	}
+
+	return s, nil
+}
+
+func (s *esPositionStore) Load() (*SyncPosition, error) {
+	r, err := s.es.Get(s.index, positionDocType, s.key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if r.Code == http.StatusNotFound || !r.Found {
+		return nil, nil
+	} else if r.Code != http.StatusOK {
+		return nil, errors.Errorf("Error: %s, code: %d", http.StatusText(r.Code), r.Code)
+	}
+
+	data, err := json.Marshal(r.Source)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var pos SyncPosition
+	err = json.Unmarshal(data, &pos)
+	return &pos, errors.Trace(err)
+}
+
+func (s *esPositionStore) Save(pos *SyncPosition) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var doc map[string]interface{}
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(s.es.Update(s.index, positionDocType, s.key, doc))
+}
+
+func (s *esPositionStore) Close() error {
+	s.es.Close()
+	return nil
+}
+
+func (s *esPositionStore) String() string {
+	return fmt.Sprintf("Elasticsearch index %s, id %s", s.index, s.key)
+}
@@ -0,0 +1,216 @@
+package river
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/client"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+const (
+	defaultPositionSchema = "go_mysql_elasticsearch"
+	defaultPositionTable  = "river_position"
+)
+
+// mysqlPositionStore saves the position in a MySQL table, one row for one river, identified by key.
+type mysqlPositionStore struct {
+	sync.Mutex
+
+	addr     string
+	user     string
+	password string
+	charset  string
+
+	schema string
+	table  string
+	key    string
+
+	conn *client.Conn
+
+	// the position saved last time, only used by Save
+	last *SyncPosition
+}
+
+func newMySQLPositionStore(c *Config, key string) (*mysqlPositionStore, error) {
+	s := &mysqlPositionStore{
+		addr:     c.MyAddr,
+		user:     c.MyUser,
+		password: c.MyPassword,
+		charset:  c.MyCharset,
+		schema:   c.PositionSchema,
+		table:    c.PositionTable,
+		key:      key,
+	}
+
+	if len(s.schema) == 0 {
+		s.schema = defaultPositionSchema
+	}
+	if len(s.table) == 0 {
+		s.table = defaultPositionTable
+	}
+
+	if _, err := s.execute(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", s.schema)); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	sql := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		name VARCHAR(255) NOT NULL,
+		bin_name VARCHAR(255) NOT NULL DEFAULT '',
+		bin_pos INT UNSIGNED NOT NULL DEFAULT 0,
+		bin_gtid TEXT,
+		snapshot TEXT,
+		updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		PRIMARY KEY(name)) ENGINE=INNODB`, s.tableName())
+	if _, err := s.execute(sql); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// the table may be created before the snapshot column is added
+	rr, err := s.execute(fmt.Sprintf("SHOW COLUMNS FROM %s LIKE 'snapshot'", s.tableName()))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if rr.RowNumber() == 0 {
+		if _, err = s.execute(fmt.Sprintf("ALTER TABLE %s ADD COLUMN snapshot TEXT AFTER bin_gtid", s.tableName())); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *mysqlPositionStore) tableName() string {
+	return fmt.Sprintf("`%s`.`%s`", s.schema, s.table)
+}
+
+// execute runs the query, and reconnects once if the connection is broken.
+func (s *mysqlPositionStore) execute(query string, args ...interface{}) (*mysql.Result, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var err error
+	for i := 0; i < 2; i++ {
+		if s.conn == nil {
+			s.conn, err = client.Connect(s.addr, s.user, s.password, "")
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+
+			if len(s.charset) > 0 {
+				if err = s.conn.SetCharset(s.charset); err != nil {
+					s.conn.Close()
+					s.conn = nil
+					return nil, errors.Trace(err)
+				}
+			}
+
+			// the table is in the source MySQL, every save would be a new binlog event
+			// which is synced and saved again, so don't write the binlog if we can.
+			if _, err = s.conn.Execute("SET SESSION sql_log_bin = 0"); err != nil {
+				log.Warnf("disable binlog for position store err %v, the position is saved every second", err)
+			}
+		}
+
+		var rr *mysql.Result
+		rr, err = s.conn.Execute(query, args...)
+		if err == nil {
+			return rr, nil
+		}
+
+		if _, ok := errors.Cause(err).(*mysql.MyError); ok {
+			// the query is wrong, no need to reconnect
+			return nil, errors.Trace(err)
+		}
+
+		log.Errorf("execute %s on position store err %v, reconnect", query, err)
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return nil, errors.Trace(err)
+}
+
+func (s *mysqlPositionStore) Load() (*SyncPosition, error) {
+	rr, err := s.execute(fmt.Sprintf("SELECT bin_name, bin_pos, bin_gtid, snapshot FROM %s WHERE name = ?", s.tableName()), s.key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if rr.RowNumber() == 0 {
+		return nil, nil
+	}
+
+	var pos SyncPosition
+	pos.Name, _ = rr.GetString(0, 0)
+	binPos, _ := rr.GetUint(0, 1)
+	pos.Pos = uint32(binPos)
+	pos.GTID, _ = rr.GetString(0, 2)
+
+	if snapshot, _ := rr.GetString(0, 3); len(snapshot) > 0 {
+		if err = json.Unmarshal([]byte(snapshot), &pos.Snapshot); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	s.last = copySyncPosition(&pos)
+	return &pos, nil
+}
+
+func (s *mysqlPositionStore) Save(pos *SyncPosition) error {
+	if s.last != nil && reflect.DeepEqual(s.last, pos) {
+		return nil
+	}
+
+	var snapshot string
+	if pos.Snapshot != nil {
+		data, err := json.Marshal(pos.Snapshot)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		snapshot = string(data)
+	}
+
+	sql := fmt.Sprintf(`INSERT INTO %s (name, bin_name, bin_pos, bin_gtid, snapshot) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE bin_name = VALUES(bin_name), bin_pos = VALUES(bin_pos), bin_gtid = VALUES(bin_gtid),
+		snapshot = VALUES(snapshot)`, s.tableName())
+
+	if _, err := s.execute(sql, s.key, pos.Name, pos.Pos, pos.GTID, snapshot); err != nil {
+		return errors.Trace(err)
+	}
+
+	s.last = copySyncPosition(pos)
+	return nil
+}
+
+func copySyncPosition(pos *SyncPosition) *SyncPosition {
+	c := *pos
+	if pos.Snapshot != nil {
+		c.Snapshot = make(map[string]string, len(pos.Snapshot))
+		for k, v := range pos.Snapshot {
+			c.Snapshot[k] = v
+		}
+	}
+	return &c
+}
+
+func (s *mysqlPositionStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	return errors.Trace(err)
+}
+
+func (s *mysqlPositionStore) String() string {
+	return fmt.Sprintf("MySQL table %s, name %s", s.tableName(), s.key)
+}
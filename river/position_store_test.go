@@ -0,0 +1,129 @@
+package river
+
+import (
+	"os"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func TestFilePositionStore(t *testing.T) {
+	dataDir := "/tmp/test_river_position"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+
+	store, err := newPositionStore(&Config{DataDir: dataDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := loadMasterInfo(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pos := m.Position(); len(pos.Name) > 0 || pos.Pos > 0 {
+		t.Fatalf("Expected: empty position, but: was %s", pos)
+	}
+
+	gset, err := mysql.ParseMysqlGTIDSet("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Save(mysql.Position{Name: "mysql-bin.000002", Pos: 1234}, gset)
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err = loadMasterInfo(store); err != nil {
+		t.Fatal(err)
+	}
+
+	if pos := m.Position(); pos.Name != "mysql-bin.000002" || pos.Pos != 1234 {
+		t.Errorf("Expected: position is (mysql-bin.000002, 1234), but: was %s", pos)
+	}
+
+	if m.GTIDSet() != gset.String() {
+		t.Errorf("Expected: GTID set is %s, but: was %s", gset, m.GTIDSet())
+	}
+}
+
+func TestSnapshotProgress(t *testing.T) {
+	dataDir := "/tmp/test_river_snapshot"
+	os.RemoveAll(dataDir)
+	defer os.RemoveAll(dataDir)
+
+	store, err := newPositionStore(&Config{DataDir: dataDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := loadMasterInfo(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.SnapshotProgress() != nil {
+		t.Fatalf("Expected: no snapshot, but: was %v", m.SnapshotProgress())
+	}
+
+	pos := mysql.Position{Name: "mysql-bin.000002", Pos: 1234}
+	if err = m.StartSnapshot(pos, nil, []string{"test:t1", "test:t2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SaveSnapshot("test:t1", snapshotDone, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SaveSnapshot("test:t2", `[10,"a"]`, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err = loadMasterInfo(store); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := m.Position(); p != pos {
+		t.Errorf("Expected: position is %s, but: was %s", pos, p)
+	}
+
+	progress := m.SnapshotProgress()
+	if progress["test:t1"] != snapshotDone || progress["test:t2"] != `[10,"a"]` {
+		t.Errorf("Expected: snapshot progress is saved, but: was %v", progress)
+	}
+
+	if err = m.FinishSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err = loadMasterInfo(store); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.SnapshotProgress() != nil {
+		t.Errorf("Expected: snapshot is finished, but: was %v", m.SnapshotProgress())
+	}
+}
+
+func TestGTIDNext(t *testing.T) {
+	info := "SET @@SESSION.GTID_NEXT= '3e11fa47-71ca-11e1-9e33-c80aa9429562:23'"
+	if gtid := gtidNext(info); gtid != "3e11fa47-71ca-11e1-9e33-c80aa9429562:23" {
+		t.Errorf("Expected: 3e11fa47-71ca-11e1-9e33-c80aa9429562:23, but: was %s", gtid)
+	}
+}
+
+func TestMySQLPositionStoreUnchanged(t *testing.T) {
+	pos := &SyncPosition{Name: "mysql-bin.000002", Pos: 1234, Snapshot: map[string]string{"test.test_river": "[1]"}}
+
+	// no MySQL server, the unchanged position must not be saved again
+	s := &mysqlPositionStore{addr: "127.0.0.1:1", schema: defaultPositionSchema, table: defaultPositionTable,
+		last: copySyncPosition(pos)}
+	if err := s.Save(pos); err != nil {
+		t.Fatal(err)
+	}
+
+	pos.Snapshot["test.test_river"] = "[2]"
+	if err := s.Save(pos); err == nil {
+		t.Fatal("Expected: the changed position is saved, but: was skipped")
+	}
+}
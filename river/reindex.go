@@ -0,0 +1,132 @@
+package river
+
+import (
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+// Reindex rebuilds the docs of index into the new index target without downtime, index can be
+// an alias or a concrete index. All the tables whose rules write to index are re-snapshotted into
+// target, and the binlog events of them are written to both index and target meanwhile. At last,
+// the alias index is moved to target atomically, if index is a concrete index, it is deleted.
+// target is created if it doesn't exist, so create it before with the new mapping if needed.
+// It returns the rule keys of the tables, and the reindex runs in background.
+func (r *River) Reindex(index string, target string) ([]string, error) {
+	if len(index) == 0 || len(target) == 0 {
+		return nil, errors.Errorf("index and target are required")
+	} else if index == target {
+		return nil, errors.Errorf("target must be different from index %s", index)
+	}
+
+	var keys []string
+	r.rulesLock.RLock()
+	for key, rule := range r.rules {
+		if rule.Index == index {
+			keys = append(keys, key)
+		}
+	}
+	r.rulesLock.RUnlock()
+	if len(keys) == 0 {
+		return nil, errors.Annotatef(ErrRuleNotExist, "index %s", index)
+	}
+	sort.Strings(keys)
+
+	exists, err := r.es.IndexExists(target)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !exists {
+		if err = r.es.CreateIndex(target, nil); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if err = r.openSnapshotWindows(keys, target); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	r.wg.Add(1)
+	go r.runReindex(keys, index, target)
+
+	return keys, nil
+}
+
+func (r *River) runReindex(keys []string, index string, target string) {
+	defer r.wg.Done()
+
+	log.Infof("reindex %s to %s for %v", index, target, keys)
+
+	if err := r.resnapshot(keys); err != nil {
+		r.closeSnapshotWindows(keys)
+		log.Errorf("reindex %s to %s err %v", index, target, err)
+		return
+	}
+
+	if err := r.moveAlias(keys, index, target); err != nil {
+		log.Errorf("reindex %s to %s is stopped before moving the alias, reindex again after restarting", index, target)
+		return
+	}
+
+	log.Infof("reindex %s to %s OK", index, target)
+}
+
+// moveAlias moves the alias index to target, and stops writing the binlog events to target after that,
+// the later requests are written to target through the alias. The events are still written to both
+// indices until the alias is moved, so target is never stale, and moving the alias is retried until
+// it succeeds or the river is closed.
+func (r *River) moveAlias(keys []string, index string, target string) error {
+	for n := 1; ; n++ {
+		err := r.runSyncTask(func() error {
+			return r.es.SwapAlias(index, target)
+		})
+		if err == nil {
+			break
+		} else if r.ctx.Err() != nil {
+			return r.ctx.Err()
+		}
+
+		d := r.bulkRetry.backoff(n)
+		log.Errorf("move alias %s to %s err %v, retry after %s", index, target, err, d)
+
+		select {
+		case <-time.After(d):
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+
+	r.closeSnapshotWindows(keys)
+	return nil
+}
+
+// runSyncTask runs fn in the sync loop after all the requests before are flushed.
+func (r *River) runSyncTask(fn func() error) error {
+	done := make(chan error, 1)
+	select {
+	case r.syncCh <- syncTask{fn: fn, done: done}:
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+
+	select {
+	case err := <-done:
+		return errors.Trace(err)
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// reindexRequests copies the requests for the new index.
+func reindexRequests(reqs []*elastic.BulkRequest, target string) []*elastic.BulkRequest {
+	copies := make([]*elastic.BulkRequest, len(reqs))
+	for i, req := range reqs {
+		c := *req
+		c.Index = target
+		copies[i] = &c
+	}
+	return copies
+}
@@ -0,0 +1,314 @@
+package river
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/client"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// ErrSnapshotRunning is the error if the table is being re-snapshotted.
+var ErrSnapshotRunning = errors.New("snapshot is running")
+
+// Re-snapshotting a table while syncing the binlog is like DBLog:
+//
+//   1. Open a window for the table, the binlog events of the table processed in the window
+//      are recorded, and the update events index the whole docs.
+//   2. Read a chunk of the table, then get the binlog position of the master.
+//   3. Wait until the binlog events before the position are processed, now the events
+//      before the chunk is read can't overwrite it.
+//   4. Close the window, and sync the rows in the chunk except the docs changed in the window,
+//      because the binlog events are newer, or the same as the rows.
+//
+// Then open the window again for the next chunk.
+
+// snapshotWindow records the docs changed by the binlog events while reading a chunk of the table.
+type snapshotWindow struct {
+	ids map[string]struct{}
+	// index is the index to write the rows to, empty for the index of the rule.
+	index string
+}
+
+func newSnapshotWindow(index string) *snapshotWindow {
+	return &snapshotWindow{ids: make(map[string]struct{}), index: index}
+}
+
+func (w *snapshotWindow) touch(reqs []*elastic.BulkRequest) {
+	for _, req := range reqs {
+		w.ids[req.ID] = struct{}{}
+	}
+}
+
+// Resnapshot re-reads the rows of the tables into ES while the binlog is still being synced.
+// table is schema.table, and the table can be a wildcard like the rule. It returns the rule keys
+// of the tables, and the tables are re-snapshotted one by one in background.
+func (r *River) Resnapshot(table string) ([]string, error) {
+	keys, err := r.matchRules(table)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err = r.openSnapshotWindows(keys, ""); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	r.wg.Add(1)
+	go r.runResnapshot(keys)
+
+	return keys, nil
+}
+
+// openSnapshotWindows opens the windows for the tables, the rows are written to index
+// if not empty, and the binlog events are written to index too.
+func (r *River) openSnapshotWindows(keys []string, index string) error {
+	r.windowLock.Lock()
+	defer r.windowLock.Unlock()
+
+	for _, key := range keys {
+		_, ok1 := r.windows[key]
+		_, ok2 := r.reindexes[key]
+		if ok1 || ok2 {
+			return errors.Annotatef(ErrSnapshotRunning, "table %s", key)
+		}
+	}
+
+	for _, key := range keys {
+		r.windows[key] = newSnapshotWindow(index)
+		if len(index) > 0 {
+			r.reindexes[key] = index
+		}
+	}
+
+	return nil
+}
+
+// closeSnapshotWindows closes the windows of the tables, and stops writing to the new index.
+func (r *River) closeSnapshotWindows(keys []string) {
+	r.windowLock.Lock()
+	defer r.windowLock.Unlock()
+
+	for _, key := range keys {
+		delete(r.windows, key)
+		delete(r.reindexes, key)
+	}
+}
+
+func (r *River) runResnapshot(keys []string) {
+	defer r.wg.Done()
+	defer r.closeSnapshotWindows(keys)
+
+	if err := r.resnapshot(keys); err != nil {
+		log.Errorf("re-snapshot %v err %v", keys, err)
+	}
+}
+
+// matchRules returns the sorted rule keys of schema.table.
+func (r *River) matchRules(table string) ([]string, error) {
+	seps := strings.SplitN(table, ".", 2)
+	if len(seps) != 2 || len(seps[0]) == 0 || len(seps[1]) == 0 {
+		return nil, errors.Errorf("invalid table %s, must be schema.table", table)
+	}
+
+	schema, name := seps[0], seps[1]
+
+	r.rulesLock.RLock()
+	defer r.rulesLock.RUnlock()
+
+	var keys []string
+	if regexp.QuoteMeta(name) != name {
+		reg, err := regexp.Compile("(?i)^" + buildTable(name) + "$")
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for key, rule := range r.rules {
+			if strings.EqualFold(rule.Schema, schema) && reg.MatchString(rule.Table) {
+				keys = append(keys, key)
+			}
+		}
+	} else if _, ok := r.rules[ruleKey(schema, name)]; ok {
+		keys = append(keys, ruleKey(schema, name))
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.Annotatef(ErrRuleNotExist, "table %s", table)
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (r *River) resnapshot(keys []string) error {
+	conn, err := client.Connect(r.c.MyAddr, r.c.MyUser, r.c.MyPassword, "")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+
+	if len(r.c.MyCharset) > 0 {
+		if err = conn.SetCharset(r.c.MyCharset); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	for _, key := range keys {
+		if err = r.resnapshotTable(conn, key); err != nil {
+			return errors.Annotatef(err, "table %s", key)
+		}
+	}
+
+	return nil
+}
+
+func (r *River) resnapshotTable(conn *client.Conn, key string) error {
+	r.rulesLock.RLock()
+	rule, ok := r.rules[key]
+	r.rulesLock.RUnlock()
+	if !ok {
+		return errors.Annotatef(ErrRuleNotExist, "table %s", key)
+	}
+
+	chunkSize := r.c.SnapshotChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultSnapshotChunkSize
+	}
+
+	log.Infof("re-snapshot table %s.%s", rule.Schema, rule.Table)
+	start := time.Now()
+
+	var last []interface{}
+	var total int
+	for {
+		// the table may be altered while re-snapshotting
+		r.rulesLock.RLock()
+		tableInfo := rule.TableInfo
+		r.rulesLock.RUnlock()
+
+		rr, err := conn.Execute(snapshotQuery(tableInfo, last, chunkSize), last...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		pos, version, err := r.masterVersion()
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err = r.waitSynced(pos); err != nil {
+			return errors.Trace(err)
+		}
+
+		rows := make([][]interface{}, 0, len(rr.Values))
+		for _, values := range rr.Values {
+			rows = append(rows, snapshotRow(tableInfo, values))
+		}
+
+		n, err := r.closeSnapshotWindow(key, rule, rows, version)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		total += n
+
+		if len(rr.Values) < chunkSize {
+			break
+		}
+
+		lastRow := rr.Values[len(rr.Values)-1]
+		last = make([]interface{}, len(tableInfo.PKColumns))
+		for i, idx := range tableInfo.PKColumns {
+			last[i] = lastRow[idx]
+		}
+	}
+
+	// the binlog events are still written to the new index until the alias is moved
+	r.windowLock.Lock()
+	delete(r.windows, key)
+	r.windowLock.Unlock()
+
+	log.Infof("re-snapshot table %s.%s OK, %d rows, use %0.2f seconds", rule.Schema, rule.Table,
+		total, time.Now().Sub(start).Seconds())
+	return nil
+}
+
+// waitSynced waits until the binlog events before pos are processed.
+// If there are no more events after rotating the binlog, we have to wait for the next one,
+// because the synced position is at the beginning of the new binlog file.
+func (r *River) waitSynced(pos mysql.Position) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for r.canal.SyncedPosition().Compare(pos) < 0 {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// closeSnapshotWindow syncs the rows not changed in the window, and opens a new window
+// for the next chunk. It returns the number of the synced rows.
+func (r *River) closeSnapshotWindow(key string, rule *Rule, rows [][]interface{}, version int64) (int, error) {
+	r.windowLock.Lock()
+	defer r.windowLock.Unlock()
+
+	w := r.windows[key]
+
+	// the rules lock is released before sending, the sync loop may wait for it, e.g, checking
+	// the mapping after DDL, while a DDL waits to change the rules.
+	r.rulesLock.RLock()
+	reqs, n, err := r.makeWindowRequests(w, rule, rows)
+	r.rulesLock.RUnlock()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	r.setVersion(reqs, version)
+
+	// send the requests with the window lock held, so the later binlog events are synced after them
+	select {
+	case r.syncCh <- reqs:
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+
+	r.windows[key] = newSnapshotWindow(w.index)
+	return n, nil
+}
+
+// makeWindowRequests makes the requests of the rows not changed in the window, and returns
+// the number of them. It must be called with the rules lock held.
+func (r *River) makeWindowRequests(w *snapshotWindow, rule *Rule, rows [][]interface{}) ([]*elastic.BulkRequest, int, error) {
+	synced := rows[:0]
+	for _, row := range rows {
+		// for the nested rows, all the rows of the parent doc changed in the window are skipped
+		id, err := r.getRowDocID(rule, row)
+		if err != nil {
+			return nil, 0, errors.Trace(err)
+		}
+
+		if _, ok := w.ids[id]; !ok {
+			synced = append(synced, row)
+		}
+	}
+
+	reqs, err := r.makeInsertRequest(rule, synced)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	if len(w.index) > 0 {
+		for _, req := range reqs {
+			req.Index = w.index
+		}
+	}
+
+	return reqs, len(synced), nil
+}
@@ -0,0 +1,302 @@
+package river
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func newTestSnapshotRiver() *River {
+	r := new(River)
+	r.c = new(Config)
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.syncCh = make(chan interface{}, 16)
+	r.windows = make(map[string]*snapshotWindow)
+	r.reindexes = make(map[string]string)
+	r.rules = make(map[string]*Rule)
+
+	for _, table := range []string{"test_river", "test_river_0000", "test_river_0001"} {
+		rule := newDefaultRule("test", table)
+		rule.TableInfo = &schema.Table{Schema: "test", Name: table}
+		rule.TableInfo.AddColumn("id", "int(11)", "", "")
+		rule.TableInfo.AddColumn("title", "varchar(256)", "", "")
+		rule.TableInfo.AddColumn("content", "varchar(256)", "", "")
+		rule.TableInfo.PKColumns = []int{0}
+		r.rules[ruleKey("test", table)] = rule
+	}
+
+	return r
+}
+
+func TestMatchRules(t *testing.T) {
+	r := newTestSnapshotRiver()
+
+	tests := []struct {
+		Table  string
+		Expect []string
+	}{
+		{"test.test_river", []string{"test:test_river"}},
+		{"TEST.Test_River", []string{"test:test_river"}},
+		{"test.test_river_[0-9]{4}", []string{"test:test_river_0000", "test:test_river_0001"}},
+		{"test.*", []string{"test:test_river", "test:test_river_0000", "test:test_river_0001"}},
+		{"test.test_none", nil},
+		{"test", nil},
+	}
+
+	for _, test := range tests {
+		keys, _ := r.matchRules(test.Table)
+		if !reflect.DeepEqual(keys, test.Expect) {
+			t.Errorf("Table: %s, Expected: %v, but: was %v", test.Table, test.Expect, keys)
+		}
+	}
+}
+
+func TestSnapshotWindow(t *testing.T) {
+	r := newTestSnapshotRiver()
+	h := &eventHandler{r}
+	key := ruleKey("test", "test_river")
+	rule := r.rules[key]
+
+	update := &canal.RowsEvent{
+		Table:  rule.TableInfo,
+		Action: canal.UpdateAction,
+		Rows: [][]interface{}{
+			{int64(1), "a", "content"},
+			{int64(1), "b", "content"},
+		},
+	}
+
+	// only the changed fields are updated without the window
+	if err := h.OnRow(update); err != nil {
+		t.Fatal(err)
+	}
+	reqs := (<-r.syncCh).([]*elastic.BulkRequest)
+	if reqs[0].Action != elastic.ActionUpdate || len(reqs[0].Data) != 1 {
+		t.Errorf("Expected: update the changed fields, but: was %s %v", reqs[0].Action, reqs[0].Data)
+	}
+
+	r.windows[key] = newSnapshotWindow("")
+
+	if err := h.OnRow(update); err != nil {
+		t.Fatal(err)
+	}
+	reqs = (<-r.syncCh).([]*elastic.BulkRequest)
+	if reqs[0].Action != elastic.ActionIndex || len(reqs[0].Data) != 3 {
+		t.Errorf("Expected: index the whole doc, but: was %s %v", reqs[0].Action, reqs[0].Data)
+	}
+
+	rows := [][]interface{}{
+		{int64(1), "a", "content"},
+		{int64(2), "c", "content"},
+	}
+	n, err := r.closeSnapshotWindow(key, rule, rows, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("Expected: 1 row synced, but: was %d", n)
+	}
+
+	reqs = (<-r.syncCh).([]*elastic.BulkRequest)
+	if len(reqs) != 1 || reqs[0].ID != "2" {
+		t.Errorf("Expected: only doc 2 synced, but: was %v", reqs)
+	}
+
+	if len(r.windows[key].ids) != 0 {
+		t.Errorf("Expected: a new window, but: was %v", r.windows[key].ids)
+	}
+}
+
+func TestSnapshotWindowUnlockRules(t *testing.T) {
+	r := newTestSnapshotRiver()
+	r.syncCh = make(chan interface{})
+	key := ruleKey("test", "test_river")
+	rule := r.rules[key]
+
+	if err := r.openSnapshotWindows([]string{key}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := r.closeSnapshotWindow(key, rule, [][]interface{}{{int64(1), "a", "content"}}, 0)
+		errCh <- err
+	}()
+
+	// the rules can be changed while the requests are waiting for the sync loop
+	time.Sleep(50 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		r.rulesLock.Lock()
+		r.rulesLock.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Errorf("Expected: the rules lock released before sending the requests")
+	}
+
+	<-r.syncCh
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotAPI(t *testing.T) {
+	r := newTestSnapshotRiver()
+	r.windows[ruleKey("test", "test_river")] = newSnapshotWindow("")
+
+	tests := []struct {
+		Method string
+		Table  string
+		Code   int
+	}{
+		{"GET", "test.test_river", http.StatusMethodNotAllowed},
+		{"POST", "", http.StatusBadRequest},
+		{"POST", "test.test_none", http.StatusNotFound},
+		{"POST", "test.test_river", http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.Method, "/snapshot?table="+test.Table, nil)
+		w := httptest.NewRecorder()
+		r.handleSnapshot(w, req)
+		if w.Code != test.Code {
+			t.Errorf("%s %s, Expected: %d, but: was %d", test.Method, test.Table, test.Code, w.Code)
+		}
+	}
+}
+
+func TestReindexAPI(t *testing.T) {
+	r := newTestSnapshotRiver()
+
+	tests := []struct {
+		Enabled bool
+		Method  string
+		Query   string
+		Code    int
+	}{
+		{false, "POST", "index=test_river&target=test_river_v2", http.StatusForbidden},
+		{true, "GET", "index=test_river&target=test_river_v2", http.StatusMethodNotAllowed},
+		{true, "POST", "index=test_river", http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		r.c.ReindexAPI = test.Enabled
+		req := httptest.NewRequest(test.Method, "/reindex?"+test.Query, nil)
+		w := httptest.NewRecorder()
+		r.handleReindex(w, req)
+		if w.Code != test.Code {
+			t.Errorf("%s %s, Expected: %d, but: was %d", test.Method, test.Query, test.Code, w.Code)
+		}
+	}
+}
+
+func TestReindexWindow(t *testing.T) {
+	r := newTestSnapshotRiver()
+	h := &eventHandler{r}
+	key := ruleKey("test", "test_river")
+	rule := r.rules[key]
+
+	if err := r.openSnapshotWindows([]string{key}, "test_river_v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.openSnapshotWindows([]string{key}, ""); errors.Cause(err) != ErrSnapshotRunning {
+		t.Errorf("Expected: %v, but: was %v", ErrSnapshotRunning, err)
+	}
+
+	insert := &canal.RowsEvent{
+		Table:  rule.TableInfo,
+		Action: canal.InsertAction,
+		Rows:   [][]interface{}{{int64(1), "a", "content"}},
+	}
+	if err := h.OnRow(insert); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := (<-r.syncCh).([]*elastic.BulkRequest)
+	if len(reqs) != 2 || reqs[0].Index != rule.Index || reqs[1].Index != "test_river_v2" {
+		t.Errorf("Expected: write to both indices, but: was %v", reqs)
+	}
+
+	if _, err := r.closeSnapshotWindow(key, rule, [][]interface{}{{int64(2), "b", "content"}}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs = (<-r.syncCh).([]*elastic.BulkRequest)
+	if len(reqs) != 1 || reqs[0].Index != "test_river_v2" {
+		t.Errorf("Expected: write the rows to the new index, but: was %v", reqs)
+	}
+
+	r.closeSnapshotWindows([]string{key})
+	if len(r.windows) != 0 || len(r.reindexes) != 0 {
+		t.Errorf("Expected: windows closed, but: was %v %v", r.windows, r.reindexes)
+	}
+}
+
+func TestReindexMoveAlias(t *testing.T) {
+	r := newTestSnapshotRiver()
+	r.bulkRetry = retryPolicy{initial: time.Millisecond, max: time.Millisecond}
+	key := ruleKey("test", "test_river")
+
+	if err := r.openSnapshotWindows([]string{key}, "test_river_v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	var swaps int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			w.Write([]byte(`{"test_river_v1":{"aliases":{"test_river":{}}}}`))
+			return
+		}
+
+		// still writing to both indices before the alias is moved
+		r.windowLock.Lock()
+		_, ok := r.reindexes[key]
+		r.windowLock.Unlock()
+		if !ok {
+			t.Errorf("Expected: write to both indices before moving the alias")
+		}
+
+		if swaps++; swaps == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"acknowledged":true}`))
+	}))
+	defer ts.Close()
+
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(ts.URL, "http://"), Version: "7.0.0"})
+	defer r.es.Close()
+
+	// the sync loop
+	go func() {
+		for v := range r.syncCh {
+			task := v.(syncTask)
+			task.done <- task.fn()
+		}
+	}()
+
+	if err := r.moveAlias([]string{key}, "test_river", "test_river_v2"); err != nil {
+		t.Fatal(err)
+	}
+	close(r.syncCh)
+
+	if swaps != 2 {
+		t.Errorf("Expected: the alias moved after retrying, but: was %d requests", swaps)
+	}
+	if len(r.windows) != 0 || len(r.reindexes) != 0 {
+		t.Errorf("Expected: windows closed, but: was %v %v", r.windows, r.reindexes)
+	}
+}
@@ -0,0 +1,136 @@
+package river
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+const (
+	defaultBulkRetryMaxAttempts    = 5
+	defaultBulkRetryInitialBackoff = 100 * time.Millisecond
+	defaultBulkRetryMaxBackoff     = 10 * time.Second
+)
+
+// bulkStatusError is returned when ES rejects the whole bulk request.
+type bulkStatusError struct {
+	code int
+}
+
+func (e *bulkStatusError) Error() string {
+	return fmt.Sprintf("bulk request failed with status %d %s", e.code, http.StatusText(e.code))
+}
+
+// isRetryableBulkError checks whether the bulk request may succeed if we send it again later,
+// e.g, the connection is broken or ES is too busy to handle it now.
+func isRetryableBulkError(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case *bulkStatusError:
+		return e.code == http.StatusTooManyRequests || e.code >= http.StatusInternalServerError
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+type retryPolicy struct {
+	maxAttempts int
+	initial     time.Duration
+	max         time.Duration
+	jitter      float64
+}
+
+func newBulkRetryPolicy(c *Config) retryPolicy {
+	p := retryPolicy{
+		maxAttempts: c.BulkRetryMaxAttempts,
+		initial:     c.BulkRetryInitialBackoff.Duration,
+		max:         c.BulkRetryMaxBackoff.Duration,
+		jitter:      c.BulkRetryJitter,
+	}
+
+	if p.maxAttempts == 0 {
+		p.maxAttempts = defaultBulkRetryMaxAttempts
+	}
+	if p.initial == 0 {
+		p.initial = defaultBulkRetryInitialBackoff
+	}
+	if p.max == 0 {
+		p.max = defaultBulkRetryMaxBackoff
+	}
+	if p.max < p.initial {
+		p.max = p.initial
+	}
+	if p.jitter < 0 {
+		p.jitter = 0
+	} else if p.jitter > 1 {
+		p.jitter = 1
+	}
+
+	return p
+}
+
+// backoff returns how long we should wait after the nth failed attempt, n starts from 1.
+// The delay doubles for each attempt until reaching max, then a random part of
+// it which is at most jitter percent is cut off to avoid all clients retrying at the same time.
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := p.max
+	if shift := uint(n - 1); shift < 32 {
+		if v := p.initial << shift; v > 0 && v < p.max {
+			d = v
+		}
+	}
+
+	if p.jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.jitter * float64(d))
+	}
+
+	return d
+}
+
+// doBulkWithRetry sends the requests to ES, the whole bulk or the items failed
+// with a retryable error will be sent again after backoff. The items which still
+// can't be synced after max attempts are put into the dead letter queue.
+func (r *River) doBulkWithRetry(reqs []*elastic.BulkRequest) error {
+	for n := 1; ; n++ {
+		retries, err := r.doBulk(reqs)
+		if err == nil && len(retries) == 0 {
+			return nil
+		}
+
+		if err != nil && !isRetryableBulkError(err) {
+			return errors.Trace(err)
+		}
+
+		if n >= r.bulkRetry.maxAttempts {
+			if err != nil {
+				return errors.Trace(err)
+			}
+			return errors.Trace(r.dlq.Put(retries))
+		}
+
+		if err == nil {
+			// only send the failed items again
+			reqs = make([]*elastic.BulkRequest, 0, len(retries))
+			for _, item := range retries {
+				reqs = append(reqs, item.req)
+			}
+			err = errors.Errorf("%d items failed", len(retries))
+		}
+
+		d := r.bulkRetry.backoff(n)
+		log.Errorf("do ES bulk err %v, retry %d/%d after %s", err, n, r.bulkRetry.maxAttempts-1, d)
+		esBulkRetryNum.Inc()
+
+		select {
+		case <-time.After(d):
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+}
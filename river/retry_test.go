@@ -0,0 +1,63 @@
+package river
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+func TestBulkRetryBackoff(t *testing.T) {
+	p := newBulkRetryPolicy(&Config{
+		BulkRetryInitialBackoff: TomlDuration{100 * time.Millisecond},
+		BulkRetryMaxBackoff:     TomlDuration{time.Second},
+	})
+
+	if p.maxAttempts != defaultBulkRetryMaxAttempts {
+		t.Errorf("Expected: max attempts is %d, but: was %d", defaultBulkRetryMaxAttempts, p.maxAttempts)
+	}
+
+	tests := []struct {
+		N      int
+		Expect time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	}
+
+	for _, test := range tests {
+		if d := p.backoff(test.N); d != test.Expect {
+			t.Errorf("Attempt: %d, Expected: is %s, but: was %s", test.N, test.Expect, d)
+		}
+	}
+
+	p.jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.backoff(5); d < 500*time.Millisecond || d > time.Second {
+			t.Errorf("Expected: backoff with jitter is in [500ms, 1s], but: was %s", d)
+		}
+	}
+}
+
+func TestRetryableBulkError(t *testing.T) {
+	tests := []struct {
+		Err    error
+		Expect bool
+	}{
+		{errors.Trace(&url.Error{Op: "Post", URL: "http://127.0.0.1:9200/_bulk", Err: errors.New("connection refused")}), true},
+		{errors.Trace(&bulkStatusError{429}), true},
+		{errors.Trace(&bulkStatusError{503}), true},
+		{errors.Trace(&bulkStatusError{400}), false},
+		{errors.New("invalid character"), false},
+	}
+
+	for _, test := range tests {
+		if isRetryableBulkError(test.Err) != test.Expect {
+			t.Errorf("Error: %v, Expected: is %t, but: was %t", test.Err, test.Expect, !test.Expect)
+		}
+	}
+}
@@ -8,11 +8,16 @@ import (
 	"sync"
 
 	"github.com/juju/errors"
+	"github.com/pingcap/parser"
 	"github.com/siddontang/go-log/log"
 	"github.com/siddontang/go-mysql-elasticsearch/elastic"
 	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
 )
 
+// binlogEventsBatch is the number of binlog events read at a time to get the GTID set of a position.
+const binlogEventsBatch = 1000
+
 // ErrRuleNotExist is the error if rule is not defined.
 var ErrRuleNotExist = errors.New("rule is not exist")
 
@@ -26,6 +31,10 @@ type River struct {
 
 	rules map[string]*Rule
 
+	// rulesLock protects the rules changed by DDL in the canal goroutine,
+	// it must be held when reading the rules in other goroutines.
+	rulesLock sync.RWMutex
+
 	ctx    context.Context
 	cancel context.CancelFunc
 
@@ -35,7 +44,39 @@ type River struct {
 
 	master *masterInfo
 
+	dlq *deadLetterQueue
+
 	syncCh chan interface{}
+
+	bulkRetry retryPolicy
+
+	// windows are the re-snapshot windows of the tables, and reindexes are the new indices
+	// the tables are being reindexed to, protected by windowLock.
+	windowLock sync.Mutex
+	windows    map[string]*snapshotWindow
+	reindexes  map[string]string
+
+	// the wildcard tables in source, used to sync the tables created at runtime
+	wildcards []*wildcardRule
+
+	// the indices which have the nested fields synced from the child tables
+	nestedIndices map[string]struct{}
+
+	// the rules which look up the tables, the key is the rule key of the lookup table
+	lookups map[string][]lookupRef
+
+	// used to parse the DDL in the canal goroutine
+	parser     *parser.Parser
+	lastDDLPos mysql.Position
+
+	// the sequence number of the current transaction, used for the external version
+	gtidSeq int64
+	// the source of the synced transactions, see gtidSource
+	gtidSource string
+	// the external version of the rows dumped by mysqldump, which have no binlog position
+	dumpVersion int64
+	// the binlog file of the current event, updated by the rotate event
+	binName string
 }
 
 // NewRiver creates the River from config
@@ -44,11 +85,64 @@ func NewRiver(c *Config) (*River, error) {
 
 	r.c = c
 	r.rules = make(map[string]*Rule)
+	r.windows = make(map[string]*snapshotWindow)
+	r.reindexes = make(map[string]string)
+	r.parser = parser.New()
 	r.syncCh = make(chan interface{}, 4096)
+	r.bulkRetry = newBulkRetryPolicy(c)
 	r.ctx, r.cancel = context.WithCancel(context.Background())
 
+	switch c.CheckpointMode {
+	case "":
+		c.CheckpointMode = checkpointModePosition
+	case checkpointModePosition, checkpointModeGTID:
+	default:
+		return nil, errors.Errorf("invalid checkpoint mode %s, must be %s or %s",
+			c.CheckpointMode, checkpointModePosition, checkpointModeGTID)
+	}
+
+	switch c.SnapshotMode {
+	case "":
+		c.SnapshotMode = snapshotModeMysqldump
+	case snapshotModeMysqldump, snapshotModeNative:
+	default:
+		return nil, errors.Errorf("invalid snapshot mode %s, must be %s or %s",
+			c.SnapshotMode, snapshotModeMysqldump, snapshotModeNative)
+	}
+
+	switch c.MappingCheck {
+	case "":
+		c.MappingCheck = mappingCheckOff
+	case mappingCheckOff, mappingCheckWarn, mappingCheckError:
+	default:
+		return nil, errors.Errorf("invalid mapping check %s, must be %s, %s or %s",
+			c.MappingCheck, mappingCheckOff, mappingCheckWarn, mappingCheckError)
+	}
+
+	switch c.ExternalVersion {
+	case "":
+		c.ExternalVersion = externalVersionOff
+	case externalVersionOff, externalVersionPosition, externalVersionGTID:
+	default:
+		return nil, errors.Errorf("invalid external version %s, must be %s, %s or %s",
+			c.ExternalVersion, externalVersionOff, externalVersionPosition, externalVersionGTID)
+	}
+
 	var err error
-	if r.master, err = loadMasterInfo(c.DataDir); err != nil {
+	if r.es, err = newElasticClient(r.c); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	store, err := newPositionStore(c)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if r.master, err = loadMasterInfo(store); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if r.dlq, err = openDeadLetterQueue(c.DataDir); err != nil {
 		return nil, errors.Trace(err)
 	}
 
@@ -60,6 +154,10 @@ func NewRiver(c *Config) (*River, error) {
 		return nil, errors.Trace(err)
 	}
 
+	if err = r.checkExternalVersion(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	if err = r.prepareCanal(); err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -69,16 +167,51 @@ func NewRiver(c *Config) (*River, error) {
 		return nil, errors.Trace(err)
 	}
 
+	go r.initStatus()
+
+	return r, nil
+}
+
+// newElasticClient creates the ES client, and detects the ES version if not set in config.
+func newElasticClient(c *Config) (*elastic.Client, error) {
 	cfg := new(elastic.ClientConfig)
-	cfg.Addr = r.c.ESAddr
-	cfg.User = r.c.ESUser
-	cfg.Password = r.c.ESPassword
-	cfg.HTTPS = r.c.ESHttps
-	r.es = elastic.NewClient(cfg)
+	for _, addr := range strings.Split(c.ESAddr, ",") {
+		if addr = strings.TrimSpace(addr); len(addr) > 0 {
+			cfg.Addrs = append(cfg.Addrs, addr)
+		}
+	}
+	cfg.HealthCheckInterval = c.ESHealthCheckInterval.Duration
+	cfg.User = c.ESUser
+	cfg.Password = c.ESPassword
+	cfg.APIKey = c.ESAPIKey
+	cfg.BearerToken = c.ESBearerToken
+	cfg.Headers = c.ESHeaders
+	cfg.HTTPS = c.ESHttps
+	cfg.Version = c.ESVersion
+	cfg.BulkMaxBytes = c.BulkMaxBytes
+
+	if c.ESHttps {
+		tlsConfig, err := elastic.NewTLSConfig(c.ESTLSCA, c.ESTLSCert, c.ESTLSKey, c.ESTLSServerName, c.ESTLSSkipVerify)
+		if err != nil {
+			return nil, errors.Annotatef(err, "create Elasticsearch TLS config")
+		}
+		cfg.TLSConfig = tlsConfig
+	} else if len(c.ESTLSCA) > 0 || len(c.ESTLSCert) > 0 || len(c.ESTLSKey) > 0 ||
+		len(c.ESTLSServerName) > 0 || c.ESTLSSkipVerify {
+		return nil, errors.New("Elasticsearch TLS settings need es_https = true")
+	}
 
-	go InitStatus(r.c.StatAddr, r.c.StatPath)
+	es := elastic.NewClient(cfg)
 
-	return r, nil
+	if len(es.Version) == 0 {
+		if err := es.DetectVersion(); err != nil {
+			es.Close()
+			return nil, errors.Annotatef(err, "detect Elasticsearch version")
+		}
+	}
+
+	log.Infof("Elasticsearch version %s", es.Version)
+	return es, nil
 }
 
 func (r *River) newCanal() error {
@@ -91,6 +224,10 @@ func (r *River) newCanal() error {
 
 	cfg.ServerID = r.c.ServerID
 	cfg.Dump.ExecutionPath = r.c.DumpExec
+	if r.c.SnapshotMode == snapshotModeNative {
+		// we take the snapshot by ourselves
+		cfg.Dump.ExecutionPath = ""
+	}
 	cfg.Dump.DiscardErr = false
 	cfg.Dump.SkipMasterData = r.c.SkipMasterData
 
@@ -100,6 +237,17 @@ func (r *River) newCanal() error {
 		}
 	}
 
+	// the changes of the lookup tables are needed to refresh the docs
+	for _, rule := range r.c.Rules {
+		for _, l := range rule.Lookups {
+			schema := l.Schema
+			if len(schema) == 0 {
+				schema = rule.Schema
+			}
+			cfg.IncludeTableRegex = append(cfg.IncludeTableRegex, schema+"\\."+regexp.QuoteMeta(l.Table))
+		}
+	}
+
 	var err error
 	r.canal, err = canal.NewCanal(cfg)
 	return errors.Trace(err)
@@ -155,13 +303,17 @@ func (r *River) updateRule(schema, table string) error {
 		return errors.Trace(err)
 	}
 
+	r.rulesLock.Lock()
 	rule.TableInfo = tableInfo
+	r.prepareColumns(rule)
+	r.rulesLock.Unlock()
 
 	return nil
 }
 
 func (r *River) parseSource() (map[string][]string, error) {
 	wildTables := make(map[string][]string, len(r.c.Sources))
+	r.wildcards = r.wildcards[:0]
 
 	// first, check sources
 	for _, s := range r.c.Sources {
@@ -200,6 +352,12 @@ func (r *River) parseSource() (map[string][]string, error) {
 				}
 
 				wildTables[ruleKey(s.Schema, table)] = tables
+
+				w, err := newWildcardRule(s.Schema, table)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+				r.wildcards = append(r.wildcards, w)
 			} else {
 				err := r.newRule(s.Schema, table)
 				if err != nil {
@@ -240,22 +398,27 @@ func (r *River) prepareRule() error {
 					return errors.Errorf("wildcard table rule %s.%s must have a index, can not empty", rule.Schema, rule.Table)
 				}
 
-				rule.prepare()
+				if err = rule.prepare(); err != nil {
+					return errors.Trace(err)
+				}
 
 				for _, table := range tables {
-					rr := r.rules[ruleKey(rule.Schema, table)]
-					rr.Index = rule.Index
-					rr.Type = rule.Type
-					rr.Parent = rule.Parent
-					rr.ID = rule.ID
-					rr.FieldMapping = rule.FieldMapping
+					inheritWildcardRule(r.rules[ruleKey(rule.Schema, table)], rule)
+				}
+
+				for _, w := range r.wildcards {
+					if ruleKey(w.schema, w.table) == ruleKey(rule.Schema, rule.Table) {
+						w.rule = rule
+					}
 				}
 			} else {
 				key := ruleKey(rule.Schema, rule.Table)
 				if _, ok := r.rules[key]; !ok {
 					return errors.Errorf("rule %s, %s not defined in source", rule.Schema, rule.Table)
 				}
-				rule.prepare()
+				if err = rule.prepare(); err != nil {
+					return errors.Trace(err)
+				}
 				r.rules[key] = rule
 			}
 		}
@@ -274,12 +437,22 @@ func (r *River) prepareRule() error {
 
 			log.Errorf("ignored table without a primary key: %s\n", rule.TableInfo.Name)
 		} else {
+			if rule.rowFilter != nil {
+				if err = rule.rowFilter.checkColumns(rule.TableInfo); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			r.prepareColumns(rule)
 			rules[key] = rule
 		}
 	}
 	r.rules = rules
 
-	return nil
+	if err = r.prepareNested(); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(r.prepareLookups())
 }
 
 func ruleKey(schema string, table string) string {
@@ -288,12 +461,50 @@ func ruleKey(schema string, table string) string {
 
 // Run syncs the data from MySQL and inserts to ES.
 func (r *River) Run() error {
+	if err := r.putRulesMapping(); err != nil {
+		log.Errorf("put mapping err %v", err)
+		return errors.Trace(err)
+	}
+
+	if err := r.checkStartupMapping(); err != nil {
+		log.Errorf("check mapping err %v", err)
+		return errors.Trace(err)
+	}
+
 	r.wg.Add(1)
 	canalSyncState.Set(float64(1))
 	go r.syncLoop()
 
-	pos := r.master.Position()
-	if err := r.canal.RunFrom(pos); err != nil {
+	var err error
+	if r.c.SnapshotMode == snapshotModeMysqldump && r.isExternalVersion() {
+		// the position before dumping, the binlog events after the dump are greater
+		if _, r.dumpVersion, err = r.masterVersion(); err != nil {
+			log.Errorf("get master version err %v", err)
+			canalSyncState.Set(0)
+			return errors.Trace(err)
+		}
+	}
+
+	if r.c.SnapshotMode == snapshotModeNative && r.needSnapshot() {
+		var pos mysql.Position
+		var gset mysql.GTIDSet
+		if pos, gset, err = r.snapshot(); err == nil {
+			if gset != nil {
+				if err = r.setGTIDSource(gset); err == nil {
+					err = r.canal.StartFromGTID(gset)
+				}
+			} else {
+				err = r.canal.RunFrom(pos)
+			}
+		}
+	} else if r.c.CheckpointMode == checkpointModeGTID {
+		err = r.startFromGTID()
+	} else {
+		pos := r.master.Position()
+		err = r.canal.RunFrom(pos)
+	}
+
+	if err != nil {
 		log.Errorf("start canal err %v", err)
 		canalSyncState.Set(0)
 		return errors.Trace(err)
@@ -302,6 +513,126 @@ func (r *River) Run() error {
 	return nil
 }
 
+// startFromGTID syncs from the saved GTID set. If only the position is saved, e.g, switched from
+// the position checkpoint, or stopped before the first transaction after dumping, it continues
+// from the GTID set of the position.
+func (r *River) startFromGTID() error {
+	pos := r.master.Position()
+	if len(r.master.GTIDSet()) > 0 || len(pos.Name) == 0 {
+		// an empty GTID set lets canal dump first, then sync from the GTID set recorded before dumping.
+		gset, err := mysql.ParseGTIDSet(r.flavor(), r.master.GTIDSet())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err = r.setGTIDSource(gset); err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Trace(r.canal.StartFromGTID(gset))
+	}
+
+	gset, err := r.positionGTIDSet(pos)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(gset.String()) == 0 {
+		// no transaction before the position, the GTID set is saved after restarting
+		log.Warnf("no GTID before %s, sync from the position", pos)
+		return errors.Trace(r.canal.RunFrom(pos))
+	}
+
+	log.Infof("sync from GTID set %s of %s", gset, pos)
+	if err = r.setGTIDSource(gset); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(r.canal.StartFromGTID(gset))
+}
+
+// positionGTIDSet returns the GTID set of the transactions before the binlog position.
+func (r *River) positionGTIDSet(pos mysql.Position) (mysql.GTIDSet, error) {
+	if r.flavor() == mysql.MariaDBFlavor {
+		rr, err := r.canal.Execute("SELECT BINLOG_GTID_POS(?, ?)", pos.Name, pos.Pos)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		s, err := rr.GetString(0, 0)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return mysql.ParseMariadbGTIDSet(s)
+	}
+
+	// the Previous_gtids event at the beginning of the binlog file has the GTID set of the former files,
+	// then add the GTIDs of the transactions in the file before the position.
+	gset, _ := mysql.ParseMysqlGTIDSet("")
+	from := uint64(4)
+	for {
+		rr, err := r.canal.Execute(fmt.Sprintf("SHOW BINLOG EVENTS IN '%s' FROM %d LIMIT %d",
+			pos.Name, from, binlogEventsBatch))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for i := range rr.Values {
+			end, _ := rr.GetUintByName(i, "End_log_pos")
+			if end > uint64(pos.Pos) {
+				return gset, nil
+			}
+			from = end
+
+			eventType, _ := rr.GetStringByName(i, "Event_type")
+			info, _ := rr.GetStringByName(i, "Info")
+			switch eventType {
+			case "Previous_gtids":
+				gset, err = mysql.ParseMysqlGTIDSet(strings.Replace(info, "\n", "", -1))
+			case "Gtid":
+				err = gset.Update(gtidNext(info))
+			}
+			if err != nil {
+				return nil, errors.Errorf("parse %s event %q at (%s, %d) err %v", eventType, info, pos.Name, end, err)
+			}
+		}
+
+		if len(rr.Values) < binlogEventsBatch {
+			return gset, nil
+		}
+	}
+}
+
+// gtidNext returns the GTID in the info of the Gtid event, e.g, SET @@SESSION.GTID_NEXT= 'uuid:1'.
+func gtidNext(info string) string {
+	if i := strings.Index(info, "'"); i >= 0 {
+		info = info[i+1:]
+	}
+	if i := strings.Index(info, "'"); i >= 0 {
+		info = info[:i]
+	}
+	return info
+}
+
+// needSnapshot checks whether we have not synced anything before, or the snapshot is not finished.
+func (r *River) needSnapshot() bool {
+	if r.master.SnapshotProgress() != nil {
+		return true
+	}
+
+	if r.c.CheckpointMode == checkpointModeGTID {
+		// if only the position is saved, e.g, switched from the position checkpoint or no GTID executed
+		// on the master, startFromGTID continues from it
+		return len(r.master.GTIDSet()) == 0 && len(r.master.Position().Name) == 0
+	}
+
+	pos := r.master.Position()
+	return len(pos.Name) == 0 || pos.Pos == 0
+}
+
+func (r *River) flavor() string {
+	if len(r.c.Flavor) == 0 {
+		return mysql.MySQLFlavor
+	}
+	return r.c.Flavor
+}
+
 // Ctx returns the internal context for outside use.
 func (r *River) Ctx() context.Context {
 	return r.ctx
@@ -318,6 +649,11 @@ func (r *River) Close() {
 	r.master.Close()
 
 	r.wg.Wait()
+
+	// the workers may put the dead letters of the in-flight bulk requests before exiting
+	r.dlq.Close()
+
+	r.es.Close()
 }
 
 func isValidTables(tables []string) bool {
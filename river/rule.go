@@ -1,8 +1,10 @@
 package river
 
 import (
+	"regexp"
 	"strings"
 
+	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/schema"
 )
 
@@ -29,9 +31,63 @@ type Rule struct {
 	//only MySQL fields in filter will be synced , default sync all fields
 	Filter []string `toml:"filter"`
 
+	// The MySQL fields in exclude will not be synced, even if in filter.
+	Exclude []string `toml:"exclude"`
+	// Only the MySQL fields matching any of include_regex will be synced if set,
+	// and the fields matching any of exclude_regex will not be synced.
+	IncludeRegex []string `toml:"include_regex"`
+	ExcludeRegex []string `toml:"exclude_regex"`
+	includeRegex []*regexp.Regexp
+	excludeRegex []*regexp.Regexp
+
+	// columns is the plan to sync the columns in columnsTable, rebuilt when TableInfo changes.
+	columns      []columnPlan
+	columnsTable *schema.Table
+
+	// Only the rows matching the where condition will be synced, e.g,
+	// status = 'published' AND deleted_at IS NULL
+	Where     string `toml:"where"`
+	rowFilter *rowFilter
+
 	// Elasticsearch pipeline
 	// To pre-process documents before indexing
 	Pipeline string `toml:"pipeline"`
+
+	// The policies to handle the DDL of the table, ignore by default.
+	// ddl_add_column: mapping, put the mapping of the new columns.
+	// ddl_rename_column: keep, sync to the old field; rename, rename the field in ES too.
+	// ddl_drop_table: stop, stop syncing the table; delete_index, delete the index too.
+	// ddl_truncate_table: delete_docs, delete all the docs in the index.
+	DDLAddColumn     string `toml:"ddl_add_column"`
+	DDLRenameColumn  string `toml:"ddl_rename_column"`
+	DDLDropTable     string `toml:"ddl_drop_table"`
+	DDLTruncateTable string `toml:"ddl_truncate_table"`
+
+	// Embed the rows as the elements of nested_field in the parent docs of index, instead
+	// of indexing them as the docs. nested_parent_id is the columns to build the parent doc id,
+	// and nested_key is the field of the element to store the doc id of the row, _key by default.
+	NestedField    string   `toml:"nested_field"`
+	NestedParentID []string `toml:"nested_parent_id"`
+	NestedKey      string   `toml:"nested_key"`
+
+	// Lookups copy the columns of the rows referenced by the foreign keys from other tables,
+	// the docs are synced again when the referenced rows are changed.
+	Lookups []*Lookup `toml:"lookup"`
+
+	// WriteMode is how the rows are written to the docs, index by default.
+	// merge: write only the fields of the table into the doc with update and doc_as_upsert,
+	// so several tables with the same doc id can be merged into one doc, and a deleted row
+	// only removes its fields, the doc is deleted if no fields are left.
+	// upsert: update the doc with all the fields of the updated row and doc_as_upsert,
+	// so the doc missing in ES is created again.
+	WriteMode string `toml:"write_mode"`
+
+	// AutoMapping puts the ES mapping generated from the table schema before syncing,
+	// the index is created if not exists.
+	AutoMapping bool `toml:"auto_mapping"`
+	// Mapping overrides the generated mapping of the ES fields, e.g,
+	// title = { type = "text", analyzer = "ik_max_word" }
+	Mapping map[string]map[string]interface{} `toml:"mapping"`
 }
 
 func newDefaultRule(schema string, table string) *Rule {
@@ -67,19 +123,123 @@ func (r *Rule) prepare() error {
 	r.Index = strings.ToLower(r.Index)
 	r.Type = strings.ToLower(r.Type)
 
+	if r.isNested() {
+		if len(r.NestedParentID) == 0 {
+			return errors.Errorf("rule %s.%s must have nested_parent_id for nested_field", r.Schema, r.Table)
+		}
+		if len(r.Parent) > 0 {
+			return errors.Errorf("rule %s.%s can't have both parent and nested_field", r.Schema, r.Table)
+		}
+		if len(r.NestedKey) == 0 {
+			r.NestedKey = defaultNestedKey
+		}
+	}
+
+	switch r.WriteMode {
+	case "":
+		r.WriteMode = writeModeIndex
+	case writeModeIndex, writeModeUpsert:
+	case writeModeMerge:
+		if r.isNested() {
+			return errors.Errorf("rule %s.%s can't use write_mode %s with nested_field", r.Schema, r.Table, r.WriteMode)
+		}
+		if len(r.Pipeline) > 0 {
+			return errors.Errorf("rule %s.%s can't use write_mode %s with pipeline", r.Schema, r.Table, r.WriteMode)
+		}
+	default:
+		return errors.Errorf("invalid write_mode %s of rule %s.%s, must be %s, %s or %s", r.WriteMode,
+			r.Schema, r.Table, writeModeIndex, writeModeMerge, writeModeUpsert)
+	}
+
+	var err error
+	if r.includeRegex, err = compileColumnRegex(r.IncludeRegex); err != nil {
+		return errors.Annotatef(err, "rule %s.%s include_regex", r.Schema, r.Table)
+	}
+	if r.excludeRegex, err = compileColumnRegex(r.ExcludeRegex); err != nil {
+		return errors.Annotatef(err, "rule %s.%s exclude_regex", r.Schema, r.Table)
+	}
+
+	if len(r.Where) > 0 {
+		f, err := parseWhere(r.Where)
+		if err != nil {
+			return errors.Annotatef(err, "rule %s.%s", r.Schema, r.Table)
+		}
+		r.rowFilter = f
+	}
+
+	for _, l := range r.Lookups {
+		if err := l.prepare(r); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err := checkDDLPolicy("ddl_add_column", r.DDLAddColumn, ddlPutMapping); err != nil {
+		return errors.Trace(err)
+	}
+	if err := checkDDLPolicy("ddl_rename_column", r.DDLRenameColumn, ddlKeepField, ddlRenameField); err != nil {
+		return errors.Trace(err)
+	}
+	if err := checkDDLPolicy("ddl_drop_table", r.DDLDropTable, ddlStop, ddlDeleteIndex); err != nil {
+		return errors.Trace(err)
+	}
+	if err := checkDDLPolicy("ddl_truncate_table", r.DDLTruncateTable, ddlDeleteDocs); err != nil {
+		return errors.Trace(err)
+	}
+
 	return nil
 }
 
-// CheckFilter checkers whether the field needs to be filtered.
-func (r *Rule) CheckFilter(field string) bool {
-	if r.Filter == nil {
-		return true
+func compileColumnRegex(exprs []string) ([]*regexp.Regexp, error) {
+	regs := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		reg, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		regs = append(regs, reg)
 	}
+	return regs, nil
+}
 
-	for _, f := range r.Filter {
-		if f == field {
+func matchAnyRegex(regs []*regexp.Regexp, s string) bool {
+	for _, reg := range regs {
+		if reg.MatchString(s) {
 			return true
 		}
 	}
 	return false
 }
+
+// CheckFilter checkers whether the field needs to be synced by filter, exclude and the regexps.
+// It is slow, use the column plan when syncing the rows.
+func (r *Rule) CheckFilter(field string) bool {
+	if r.Filter != nil {
+		found := false
+		for _, f := range r.Filter {
+			if f == field {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, f := range r.Exclude {
+		if f == field {
+			return false
+		}
+	}
+
+	if len(r.includeRegex) > 0 && !matchAnyRegex(r.includeRegex, field) {
+		return false
+	}
+
+	return !matchAnyRegex(r.excludeRegex, field)
+}
+
+// MatchRow checks whether the row matches the where condition, the row always matches if no where.
+func (r *Rule) MatchRow(row []interface{}) bool {
+	return r.rowFilter == nil || r.rowFilter.match(r.TableInfo, row)
+}
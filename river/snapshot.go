@@ -0,0 +1,368 @@
+package river
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/client"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+const (
+	// snapshotModeMysqldump uses mysqldump to fetch the origin data, it is the default mode.
+	snapshotModeMysqldump = "mysqldump"
+	// snapshotModeNative reads the tables in primary key chunks over a normal connection.
+	snapshotModeNative = "native"
+
+	defaultSnapshotChunkSize = 1000
+
+	// snapshotDone is the progress of the table which is copied completely.
+	snapshotDone = "done"
+)
+
+// snapshot reads all the tables in rules in one consistent snapshot, and sends the rows to the
+// sync loop as insert requests. It returns the binlog position and GTID set of the snapshot,
+// the binlog replication should start from them.
+func (r *River) snapshot() (mysql.Position, mysql.GTIDSet, error) {
+	var pos mysql.Position
+	var gset mysql.GTIDSet
+
+	conn, err := client.Connect(r.c.MyAddr, r.c.MyUser, r.c.MyPassword, "")
+	if err != nil {
+		return pos, nil, errors.Trace(err)
+	}
+	defer conn.Close()
+
+	if len(r.c.MyCharset) > 0 {
+		if err = conn.SetCharset(r.c.MyCharset); err != nil {
+			return pos, nil, errors.Trace(err)
+		}
+	}
+
+	start := time.Now()
+
+	progress := r.master.SnapshotProgress()
+	if progress == nil {
+		log.Info("start native snapshot")
+
+		if pos, gset, err = r.beginSnapshot(conn); err != nil {
+			return pos, nil, errors.Trace(err)
+		}
+
+		keys := r.snapshotRuleKeys()
+		if err = r.master.StartSnapshot(pos, gset, keys); err != nil {
+			return pos, nil, errors.Trace(err)
+		}
+
+		progress = make(map[string]string, len(keys))
+	} else {
+		// the rows copied after the snapshot position are changed by the binlog events again later,
+		// so we can continue copying the rest rows in a new transaction.
+		pos = r.master.Position()
+		if r.c.CheckpointMode == checkpointModeGTID {
+			if gset, err = mysql.ParseGTIDSet(r.flavor(), r.master.GTIDSet()); err != nil {
+				return pos, nil, errors.Trace(err)
+			}
+		}
+
+		log.Infof("resume native snapshot at binlog position %s", pos)
+
+		if err = startSnapshotTransaction(conn); err != nil {
+			return pos, nil, errors.Trace(err)
+		}
+	}
+
+	version, err := r.snapshotVersion(pos, gset)
+	if err != nil {
+		return pos, nil, errors.Trace(err)
+	}
+
+	for _, key := range r.snapshotRuleKeys() {
+		if progress[key] == snapshotDone {
+			continue
+		}
+
+		if err = r.snapshotTable(conn, key, progress[key], version); err != nil {
+			return pos, nil, errors.Trace(err)
+		}
+	}
+
+	if _, err = conn.Execute("COMMIT"); err != nil {
+		return pos, nil, errors.Trace(err)
+	}
+
+	if err = r.sendSnapshotSaver(snapshotSaver{force: true}); err != nil {
+		return pos, nil, errors.Trace(err)
+	}
+
+	log.Infof("native snapshot OK, use %0.2f seconds, start binlog replication at %s",
+		time.Now().Sub(start).Seconds(), pos)
+	return pos, gset, nil
+}
+
+// beginSnapshot starts a consistent snapshot transaction on conn, and gets the binlog position
+// at the same time with the global read lock. If skip_master_data is set, we have no privilege
+// to lock, so the position is got before the transaction, and some changes may be synced twice.
+func (r *River) beginSnapshot(conn *client.Conn) (mysql.Position, mysql.GTIDSet, error) {
+	var pos mysql.Position
+	var gset mysql.GTIDSet
+	var err error
+
+	if !r.c.SkipMasterData {
+		if _, err = conn.Execute("FLUSH TABLES WITH READ LOCK"); err != nil {
+			return pos, nil, errors.Trace(err)
+		}
+		defer conn.Execute("UNLOCK TABLES")
+	}
+
+	if pos, err = r.canal.GetMasterPos(); err != nil {
+		return pos, nil, errors.Trace(err)
+	}
+
+	if r.c.CheckpointMode == checkpointModeGTID {
+		if gset, err = r.canal.GetMasterGTIDSet(); err != nil {
+			return pos, nil, errors.Trace(err)
+		}
+	}
+
+	if err = startSnapshotTransaction(conn); err != nil {
+		return pos, nil, errors.Trace(err)
+	}
+
+	return pos, gset, nil
+}
+
+func startSnapshotTransaction(conn *client.Conn) error {
+	if _, err := conn.Execute("SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err := conn.Execute("START TRANSACTION WITH CONSISTENT SNAPSHOT")
+	return errors.Trace(err)
+}
+
+func (r *River) sendSnapshotSaver(s snapshotSaver) error {
+	select {
+	case r.syncCh <- s:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+func (r *River) snapshotRuleKeys() []string {
+	keys := make([]string, 0, len(r.rules))
+	for key := range r.rules {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// snapshotTable reads the table of rule in primary key order, chunk by chunk,
+// from the last primary key in progress, or from the beginning if progress is empty.
+func (r *River) snapshotTable(conn *client.Conn, key string, progress string, version int64) error {
+	rule := r.rules[key]
+
+	chunkSize := r.c.SnapshotChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultSnapshotChunkSize
+	}
+
+	last, err := decodeSnapshotProgress(progress)
+	if err != nil {
+		return errors.Annotatef(err, "invalid snapshot progress %s of %s", progress, key)
+	}
+
+	if last != nil {
+		log.Infof("snapshot table %s.%s after primary key %s", rule.Schema, rule.Table, progress)
+	} else {
+		log.Infof("snapshot table %s.%s", rule.Schema, rule.Table)
+	}
+
+	var total int
+	for {
+		rr, err := conn.Execute(snapshotQuery(rule.TableInfo, last, chunkSize), last...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		rows := make([][]interface{}, 0, len(rr.Values))
+		for _, values := range rr.Values {
+			rows = append(rows, snapshotRow(rule.TableInfo, values))
+		}
+
+		if len(rows) == 0 {
+			break
+		}
+
+		reqs, err := r.makeInsertRequest(rule, rows)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		r.setVersion(reqs, version)
+
+		select {
+		case r.syncCh <- reqs:
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+
+		total += len(rows)
+
+		if len(rows) < chunkSize {
+			break
+		}
+
+		lastRow := rr.Values[len(rr.Values)-1]
+		last = make([]interface{}, len(rule.TableInfo.PKColumns))
+		for i, idx := range rule.TableInfo.PKColumns {
+			last[i] = lastRow[idx]
+		}
+
+		if progress, err = encodeSnapshotProgress(last); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err = r.sendSnapshotSaver(snapshotSaver{key: key, progress: progress}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	log.Infof("snapshot table %s.%s OK, %d rows", rule.Schema, rule.Table, total)
+	return r.sendSnapshotSaver(snapshotSaver{key: key, progress: snapshotDone, force: true})
+}
+
+// encodeSnapshotProgress encodes the primary key values in JSON.
+func encodeSnapshotProgress(last []interface{}) (string, error) {
+	values := make([]interface{}, len(last))
+	for i, v := range last {
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		values[i] = v
+	}
+
+	data, err := json.Marshal(values)
+	return string(data), errors.Trace(err)
+}
+
+// decodeSnapshotProgress decodes the primary key values, returns nil if progress is empty.
+func decodeSnapshotProgress(progress string) ([]interface{}, error) {
+	if len(progress) == 0 {
+		return nil, nil
+	}
+
+	d := json.NewDecoder(strings.NewReader(progress))
+	d.UseNumber()
+
+	var values []interface{}
+	if err := d.Decode(&values); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for i, v := range values {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+
+		if d, err := n.Int64(); err == nil {
+			values[i] = d
+		} else if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+			values[i] = u
+		} else if f, err := n.Float64(); err == nil {
+			values[i] = f
+		} else {
+			values[i] = n.String()
+		}
+	}
+
+	return values, nil
+}
+
+// snapshotQuery builds the query to read the next chunk after the primary key values in last,
+// or the first chunk if last is nil.
+func snapshotQuery(table *schema.Table, last []interface{}, limit int) string {
+	return chunkQuery(table, "", last, limit)
+}
+
+// chunkQuery selects the rows matching cond after the primary key last, cond is ignored if empty.
+func chunkQuery(table *schema.Table, cond string, last []interface{}, limit int) string {
+	columns := make([]string, len(table.Columns))
+	for i, c := range table.Columns {
+		columns[i] = quoteName(c.Name)
+	}
+
+	pks := make([]string, len(table.PKColumns))
+	marks := make([]string, len(table.PKColumns))
+	for i := range table.PKColumns {
+		pks[i] = quoteName(table.GetPKColumn(i).Name)
+		marks[i] = "?"
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s.%s", strings.Join(columns, ", "),
+		quoteName(table.Schema), quoteName(table.Name))
+
+	var conds []string
+	if len(cond) > 0 {
+		conds = append(conds, cond)
+	}
+	if last != nil {
+		if len(pks) == 1 {
+			conds = append(conds, fmt.Sprintf("%s > ?", pks[0]))
+		} else {
+			conds = append(conds, fmt.Sprintf("(%s) > (%s)", strings.Join(pks, ", "), strings.Join(marks, ", ")))
+		}
+	}
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	return query + fmt.Sprintf(" ORDER BY %s LIMIT %d", strings.Join(pks, ", "), limit)
+}
+
+func quoteName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// snapshotRow converts the values read from MySQL to the same types as the mysqldump rows,
+// most of the values are returned as []byte by the MySQL protocol.
+func snapshotRow(table *schema.Table, values []interface{}) []interface{} {
+	row := make([]interface{}, len(values))
+	for i, v := range values {
+		row[i] = snapshotValue(&table.Columns[i], v)
+	}
+	return row
+}
+
+func snapshotValue(col *schema.TableColumn, value interface{}) interface{} {
+	v, ok := value.([]byte)
+	if !ok {
+		return value
+	}
+
+	switch col.Type {
+	case schema.TYPE_NUMBER:
+		if col.IsUnsigned {
+			if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+				return n
+			}
+		} else if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return n
+		}
+	case schema.TYPE_FLOAT, schema.TYPE_DECIMAL:
+		if f, err := strconv.ParseFloat(string(v), 64); err == nil {
+			return f
+		}
+	}
+
+	return string(v)
+}
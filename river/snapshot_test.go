@@ -0,0 +1,89 @@
+package river
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func TestSnapshotQuery(t *testing.T) {
+	table := &schema.Table{Schema: "test", Name: "test_river"}
+	table.AddColumn("id", "int(11)", "", "")
+	table.AddColumn("name", "varchar(256)", "", "")
+	table.AddColumn("price", "decimal(10,2) unsigned", "", "")
+	table.PKColumns = []int{0}
+
+	tests := []struct {
+		PKColumns []int
+		Last      []interface{}
+		Expect    string
+	}{
+		{[]int{0}, nil, "SELECT `id`, `name`, `price` FROM `test`.`test_river` ORDER BY `id` LIMIT 10"},
+		{[]int{0}, []interface{}{1}, "SELECT `id`, `name`, `price` FROM `test`.`test_river` WHERE `id` > ? ORDER BY `id` LIMIT 10"},
+		{[]int{0, 1}, []interface{}{1, "a"}, "SELECT `id`, `name`, `price` FROM `test`.`test_river` WHERE (`id`, `name`) > (?, ?) ORDER BY `id`, `name` LIMIT 10"},
+	}
+
+	for _, test := range tests {
+		table.PKColumns = test.PKColumns
+		if query := snapshotQuery(table, test.Last, 10); query != test.Expect {
+			t.Errorf("Expected: %s, but: was %s", test.Expect, query)
+		}
+	}
+
+	row := snapshotRow(table, []interface{}{[]byte("1"), []byte("a"), nil})
+	if expect := []interface{}{int64(1), "a", nil}; !reflect.DeepEqual(row, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, row)
+	}
+
+	row = snapshotRow(table, []interface{}{int64(2), []byte("b"), []byte("1.50")})
+	if expect := []interface{}{int64(2), "b", 1.5}; !reflect.DeepEqual(row, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, row)
+	}
+}
+
+func TestSnapshotProgressEncoding(t *testing.T) {
+	progress, err := encodeSnapshotProgress([]interface{}{int64(10), uint64(18446744073709551615), []byte("a"), 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expect := `[10,18446744073709551615,"a",1.5]`; progress != expect {
+		t.Errorf("Expected: %s, but: was %s", expect, progress)
+	}
+
+	last, err := decodeSnapshotProgress(progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expect := []interface{}{int64(10), uint64(18446744073709551615), "a", 1.5}; !reflect.DeepEqual(last, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, last)
+	}
+
+	if last, err = decodeSnapshotProgress(""); err != nil || last != nil {
+		t.Errorf("Expected: nil for empty progress, but: was %v, %v", last, err)
+	}
+}
+
+func TestNeedSnapshot(t *testing.T) {
+	r := new(River)
+	r.c = &Config{CheckpointMode: checkpointModeGTID, SnapshotMode: snapshotModeNative}
+	r.master = new(masterInfo)
+
+	if !r.needSnapshot() {
+		t.Errorf("Expected a snapshot without any saved position")
+	}
+
+	// switched from the position checkpoint, continue from the GTID set of the position
+	r.master.SyncPosition = SyncPosition{Name: "mysql-bin.000002", Pos: 154}
+	if r.needSnapshot() {
+		t.Errorf("Expected no snapshot with the saved position")
+	}
+
+	r.master.SyncPosition = SyncPosition{Name: "mysql-bin.000002", Pos: 154,
+		Snapshot: map[string]string{"test:t": "[1]"}}
+	if !r.needSnapshot() {
+		t.Errorf("Expected the unfinished snapshot continued")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"reflect"
 	"strings"
 	"time"
@@ -28,77 +29,150 @@ const mysqlDateFormat = "2006-01-02"
 
 type posSaver struct {
 	pos   mysql.Position
+	gset  mysql.GTIDSet
 	force bool
 }
 
+// snapshotSaver saves the progress of the native snapshot after the requests before it are flushed,
+// the snapshot is finished if key is empty.
+type snapshotSaver struct {
+	key      string
+	progress string
+	force    bool
+}
+
+// syncTask runs fn in the sync loop after all the requests before it are flushed,
+// and sends the result to done.
+type syncTask struct {
+	fn   func() error
+	done chan error
+}
+
 type eventHandler struct {
 	r *River
 }
 
 func (h *eventHandler) OnRotate(e *replication.RotateEvent) error {
-	pos := mysql.Position{
-		Name: string(e.NextLogName),
-		Pos:  uint32(e.Position),
-	}
-
-	h.r.syncCh <- posSaver{pos, true}
-
+	h.r.binName = string(e.NextLogName)
 	return h.r.ctx.Err()
 }
 
 func (h *eventHandler) OnTableChanged(schema, table string) error {
+	if err := h.r.updateLookupTable(schema, table); err != nil {
+		return errors.Trace(err)
+	}
+
 	err := h.r.updateRule(schema, table)
+	if err == ErrRuleNotExist {
+		// the table may be created just now
+		err = h.r.addWildcardTable(schema, table)
+	}
 	if err != nil && err != ErrRuleNotExist {
 		return errors.Trace(err)
 	}
 	return nil
 }
 
-func (h *eventHandler) OnDDL(nextPos mysql.Position, _ *replication.QueryEvent) error {
-	h.r.syncCh <- posSaver{nextPos, true}
+func (h *eventHandler) OnDDL(nextPos mysql.Position, e *replication.QueryEvent) error {
+	if err := h.r.handleDDL(nextPos, e); err != nil {
+		h.r.cancel()
+		return errors.Errorf("handle DDL %s err %v, close sync", e.Query, err)
+	}
 	return h.r.ctx.Err()
 }
 
 func (h *eventHandler) OnXID(nextPos mysql.Position) error {
-	h.r.syncCh <- posSaver{nextPos, false}
 	return h.r.ctx.Err()
 }
 
 func (h *eventHandler) OnRow(e *canal.RowsEvent) error {
-	rule, ok := h.r.rules[ruleKey(e.Table.Schema, e.Table.Name)]
+	version, err := h.r.eventVersion(e)
+	if err != nil {
+		h.r.cancel()
+		return errors.Errorf("get external version of %s.%s err %v, close sync", e.Table.Schema, e.Table.Name, err)
+	}
+
+	if err := h.r.refreshLookup(e, version); err != nil {
+		h.r.cancel()
+		return errors.Errorf("refresh lookup of %s.%s err %v, close sync", e.Table.Schema, e.Table.Name, err)
+	}
+
+	key := ruleKey(e.Table.Schema, e.Table.Name)
+	rule, ok := h.r.rules[key]
 	if !ok {
 		return nil
 	}
 
+	// the docs changed in the re-snapshot window must not be overwritten by the rows read before,
+	// see resnapshot.go.
+	h.r.windowLock.Lock()
+	w := h.r.windows[key]
+
 	var reqs []*elastic.BulkRequest
-	var err error
 	switch e.Action {
 	case canal.InsertAction:
 		reqs, err = h.r.makeInsertRequest(rule, e.Rows)
 	case canal.DeleteAction:
 		reqs, err = h.r.makeDeleteRequest(rule, e.Rows)
 	case canal.UpdateAction:
-		reqs, err = h.r.makeUpdateRequest(rule, e.Rows)
+		// the external version can't be used for the update action
+		reqs, err = h.r.makeUpdateRequest(rule, e.Rows, w != nil || h.r.isExternalVersion())
 	default:
 		err = errors.Errorf("invalid rows action %s", e.Action)
 	}
 
 	if err != nil {
+		h.r.windowLock.Unlock()
 		h.r.cancel()
 		return errors.Errorf("make %s ES request err %v, close sync", e.Action, err)
 	}
 
-	h.r.syncCh <- reqs
+	h.r.setVersion(reqs, version)
+	setPosition(reqs, h.r.eventPosition(e))
+
+	if target, ok := h.r.reindexes[key]; ok {
+		reqs = append(reqs, reindexRequests(reqs, target)...)
+	}
+
+	if w != nil {
+		w.touch(reqs)
+	}
+
+	// send with the lock held, so the requests are in order with the ones of the snapshot and reindex
+	select {
+	case h.r.syncCh <- reqs:
+	case <-h.r.ctx.Done():
+	}
+	h.r.windowLock.Unlock()
 
 	return h.r.ctx.Err()
 }
 
 func (h *eventHandler) OnGTID(gtid mysql.GTIDSet) error {
+	source, seq, err := gtidSource(gtid)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = h.r.checkGTIDSource(source); err != nil {
+		return errors.Trace(err)
+	}
+	h.r.gtidSeq = seq
 	return nil
 }
 
+// OnPosSynced is called after rotate, XID and DDL events, and the dump is done,
+// force is true for the rotate and DDL event, and after dumping.
 func (h *eventHandler) OnPosSynced(pos mysql.Position, set mysql.GTIDSet, force bool) error {
-	return nil
+	if h.r.c.CheckpointMode != checkpointModeGTID {
+		set = nil
+	}
+
+	select {
+	case h.r.syncCh <- posSaver{pos, set, force}:
+	case <-h.r.ctx.Done():
+	}
+
+	return h.r.ctx.Err()
 }
 
 func (h *eventHandler) String() string {
@@ -116,65 +190,102 @@ func (r *River) syncLoop() {
 		interval = 200 * time.Millisecond
 	}
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
 	defer r.wg.Done()
 
-	lastSavedTime := time.Now()
-	reqs := make([]*elastic.BulkRequest, 0, 1024)
+	workers := r.newBulkWorkers(bulkSize, interval)
+	for _, w := range workers {
+		r.wg.Add(1)
+		go w.run()
+	}
 
-	var pos mysql.Position
+	lastSavedTime := time.Now()
 
 	for {
-		needFlush := false
-		needSavePos := false
-
 		select {
 		case v := <-r.syncCh:
 			switch v := v.(type) {
 			case posSaver:
 				now := time.Now()
-				if v.force || now.Sub(lastSavedTime) > 3*time.Second {
-					lastSavedTime = now
-					needFlush = true
-					needSavePos = true
-					pos = v.pos
+				if !v.force && now.Sub(lastSavedTime) <= 3*time.Second {
+					continue
+				}
+				lastSavedTime = now
+
+				// the position can be saved only after all the requests before it are flushed
+				if !flushWorkers(workers) {
+					return
+				}
+
+				if err := r.master.Save(v.pos, v.gset); err != nil {
+					log.Errorf("save sync position %s err %v, close sync", v.pos, err)
+					r.cancel()
+					return
+				}
+			case snapshotSaver:
+				now := time.Now()
+				if !v.force && now.Sub(lastSavedTime) <= 3*time.Second {
+					continue
+				}
+				lastSavedTime = now
+
+				if !flushWorkers(workers) {
+					return
+				}
+
+				var err error
+				if len(v.key) == 0 {
+					err = r.master.FinishSnapshot()
+				} else {
+					err = r.master.SaveSnapshot(v.key, v.progress, v.force)
+				}
+				if err != nil {
+					log.Errorf("save snapshot progress err %v, close sync", err)
+					r.cancel()
+					return
+				}
+			case syncTask:
+				if !flushWorkers(workers) {
+					return
+				}
+
+				err := v.fn()
+				if v.done != nil {
+					v.done <- err
+				} else if err != nil {
+					log.Errorf("run sync task err %v, close sync", err)
+					r.cancel()
+					return
 				}
 			case []*elastic.BulkRequest:
-				reqs = append(reqs, v...)
-				needFlush = len(reqs) >= bulkSize
+				if !dispatch(workers, v) {
+					return
+				}
 			}
-		case <-ticker.C:
-			needFlush = true
 		case <-r.ctx.Done():
 			return
 		}
-
-		if needFlush {
-			// TODO: retry some times?
-			if err := r.doBulk(reqs); err != nil {
-				log.Errorf("do ES bulk err %v, close sync", err)
-				r.cancel()
-				return
-			}
-			reqs = reqs[0:0]
-		}
-
-		if needSavePos {
-			if err := r.master.Save(pos); err != nil {
-				log.Errorf("save sync position %s err %v, close sync", pos, err)
-				r.cancel()
-				return
-			}
-		}
 	}
 }
 
-// for insert and delete
-func (r *River) makeRequest(rule *Rule, action string, rows [][]interface{}) ([]*elastic.BulkRequest, error) {
+// for insert and delete, the lookups of the inserted rows are added to the batch
+func (r *River) makeRequest(rule *Rule, action string, rows [][]interface{}, lookups *lookupBatch) ([]*elastic.BulkRequest, error) {
 	reqs := make([]*elastic.BulkRequest, 0, len(rows))
 
 	for _, values := range rows {
+		// the row not matching the where condition is never synced
+		if !rule.MatchRow(values) {
+			continue
+		}
+
+		if rule.isNested() {
+			req, err := r.makeNestedRequest(rule, values, action == canal.DeleteAction, lookups)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			reqs = append(reqs, req)
+			continue
+		}
+
 		id, err := r.getDocID(rule, values)
 		if err != nil {
 			return nil, errors.Trace(err)
@@ -191,9 +302,13 @@ func (r *River) makeRequest(rule *Rule, action string, rows [][]interface{}) ([]
 
 		if action == canal.DeleteAction {
 			req.Action = elastic.ActionDelete
+			r.removeMergedFields(rule, req)
 			esDeleteNum.WithLabelValues(rule.Index).Inc()
 		} else {
-			r.makeInsertReqData(req, rule, values)
+			if err = r.makeInsertReqData(req, rule, values, lookups); err != nil {
+				return nil, errors.Trace(err)
+			}
+			r.keepOtherFields(rule, req)
 			esInsertNum.WithLabelValues(rule.Index).Inc()
 		}
 
@@ -204,21 +319,62 @@ func (r *River) makeRequest(rule *Rule, action string, rows [][]interface{}) ([]
 }
 
 func (r *River) makeInsertRequest(rule *Rule, rows [][]interface{}) ([]*elastic.BulkRequest, error) {
-	return r.makeRequest(rule, canal.InsertAction, rows)
+	lookups := new(lookupBatch)
+	reqs, err := r.makeRequest(rule, canal.InsertAction, rows, lookups)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = r.loadLookups(lookups); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return reqs, nil
 }
 
 func (r *River) makeDeleteRequest(rule *Rule, rows [][]interface{}) ([]*elastic.BulkRequest, error) {
-	return r.makeRequest(rule, canal.DeleteAction, rows)
+	return r.makeRequest(rule, canal.DeleteAction, rows, nil)
 }
 
-func (r *River) makeUpdateRequest(rule *Rule, rows [][]interface{}) ([]*elastic.BulkRequest, error) {
+// makeUpdateRequest updates the changed fields of the docs, if indexDoc is true,
+// the whole docs are indexed with the rows after updating.
+func (r *River) makeUpdateRequest(rule *Rule, rows [][]interface{}, indexDoc bool) ([]*elastic.BulkRequest, error) {
 	if len(rows)%2 != 0 {
 		return nil, errors.Errorf("invalid update rows event, must have 2x rows, but %d", len(rows))
 	}
 
 	reqs := make([]*elastic.BulkRequest, 0, len(rows))
+	lookups := new(lookupBatch)
 
 	for i := 0; i < len(rows); i += 2 {
+		beforeMatch, afterMatch := rule.MatchRow(rows[i]), rule.MatchRow(rows[i+1])
+		if !beforeMatch && !afterMatch {
+			continue
+		} else if !afterMatch {
+			// the row is moved out of the where condition
+			delReqs, err := r.makeDeleteRequest(rule, rows[i:i+1])
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			reqs = append(reqs, delReqs...)
+			continue
+		} else if !beforeMatch {
+			// the row is moved into the where condition
+			insertReqs, err := r.makeRequest(rule, canal.InsertAction, rows[i+1:i+2], lookups)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			reqs = append(reqs, insertReqs...)
+			continue
+		}
+
+		if rule.isNested() {
+			nestedReqs, err := r.makeNestedUpdateRequest(rule, rows[i], rows[i+1], lookups)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			reqs = append(reqs, nestedReqs...)
+			continue
+		}
+
 		beforeID, err := r.getDocID(rule, rows[i])
 		if err != nil {
 			return nil, errors.Trace(err)
@@ -244,22 +400,38 @@ func (r *River) makeUpdateRequest(rule *Rule, rows [][]interface{}) ([]*elastic.
 
 		if beforeID != afterID || beforeParentID != afterParentID {
 			req.Action = elastic.ActionDelete
+			r.removeMergedFields(rule, req)
 			reqs = append(reqs, req)
 
 			req = &elastic.BulkRequest{Index: rule.Index, Type: rule.Type, ID: afterID, Parent: afterParentID, Pipeline: rule.Pipeline}
-			r.makeInsertReqData(req, rule, rows[i+1])
+			if err = r.makeInsertReqData(req, rule, rows[i+1], lookups); err != nil {
+				return nil, errors.Trace(err)
+			}
+			r.keepOtherFields(rule, req)
 
 			esDeleteNum.WithLabelValues(rule.Index).Inc()
 			esInsertNum.WithLabelValues(rule.Index).Inc()
 		} else {
-			if len(rule.Pipeline) > 0 {
-				// Pipelines can only be specified on index action
-				r.makeInsertReqData(req, rule, rows[i+1])
+			if len(rule.Pipeline) > 0 || indexDoc || rule.isMerged() {
+				// Pipelines can only be specified on index action,
+				// and the merged fields are all written, so the doc is complete if it is created
+				if err = r.makeInsertReqData(req, rule, rows[i+1], lookups); err != nil {
+					return nil, errors.Trace(err)
+				}
 				// Make sure action is index, not create
 				req.Action = elastic.ActionIndex
 				req.Pipeline = rule.Pipeline
+				r.keepOtherFields(rule, req)
+			} else if rule.WriteMode == writeModeUpsert {
+				// the doc may be missing, e.g, the index is rebuilt or the insert failed before
+				if err = r.makeInsertReqData(req, rule, rows[i+1], lookups); err != nil {
+					return nil, errors.Trace(err)
+				}
+				upsertDoc(req)
 			} else {
-				r.makeUpdateReqData(req, rule, rows[i], rows[i+1])
+				if err = r.makeUpdateReqData(req, rule, rows[i], rows[i+1], lookups); err != nil {
+					return nil, errors.Trace(err)
+				}
 			}
 			esUpdateNum.WithLabelValues(rule.Index).Inc()
 		}
@@ -267,6 +439,9 @@ func (r *River) makeUpdateRequest(rule *Rule, rows [][]interface{}) ([]*elastic.
 		reqs = append(reqs, req)
 	}
 
+	if err := r.loadLookups(lookups); err != nil {
+		return nil, errors.Trace(err)
+	}
 	return reqs, nil
 }
 
@@ -366,56 +541,51 @@ func (r *River) getFieldParts(k string, v string) (string, string, string) {
 	return mysql, elastic, fieldType
 }
 
-func (r *River) makeInsertReqData(req *elastic.BulkRequest, rule *Rule, values []interface{}) {
+func (r *River) makeInsertReqData(req *elastic.BulkRequest, rule *Rule, values []interface{}, lookups *lookupBatch) error {
 	req.Data = make(map[string]interface{}, len(values))
 	req.Action = elastic.ActionIndex
 
+	plans := r.columnPlan(rule)
 	for i, c := range rule.TableInfo.Columns {
-		if !rule.CheckFilter(c.Name) {
+		plan := plans[i]
+		if !plan.synced {
 			continue
 		}
-		mapped := false
-		for k, v := range rule.FieldMapping {
-			mysql, elastic, fieldType := r.getFieldParts(k, v)
-			if mysql == c.Name {
-				mapped = true
-				req.Data[elastic] = r.getFieldValue(&c, fieldType, values[i])
-			}
-		}
-		if mapped == false {
+		if plan.mapped {
+			req.Data[plan.field] = r.getFieldValue(&c, plan.fieldType, values[i])
+		} else {
 			req.Data[c.Name] = r.makeReqColumnData(&c, values[i])
 		}
 	}
+
+	return errors.Trace(r.makeRowLookupData(req.Data, rule, values, lookups))
 }
 
 func (r *River) makeUpdateReqData(req *elastic.BulkRequest, rule *Rule,
-	beforeValues []interface{}, afterValues []interface{}) {
+	beforeValues []interface{}, afterValues []interface{}, lookups *lookupBatch) error {
 	req.Data = make(map[string]interface{}, len(beforeValues))
 
 	// maybe dangerous if something wrong delete before?
 	req.Action = elastic.ActionUpdate
 
+	plans := r.columnPlan(rule)
 	for i, c := range rule.TableInfo.Columns {
-		mapped := false
-		if !rule.CheckFilter(c.Name) {
+		plan := plans[i]
+		if !plan.synced {
 			continue
 		}
 		if reflect.DeepEqual(beforeValues[i], afterValues[i]) {
 			//nothing changed
 			continue
 		}
-		for k, v := range rule.FieldMapping {
-			mysql, elastic, fieldType := r.getFieldParts(k, v)
-			if mysql == c.Name {
-				mapped = true
-				req.Data[elastic] = r.getFieldValue(&c, fieldType, afterValues[i])
-			}
-		}
-		if mapped == false {
+		if plan.mapped {
+			req.Data[plan.field] = r.getFieldValue(&c, plan.fieldType, afterValues[i])
+		} else {
 			req.Data[c.Name] = r.makeReqColumnData(&c, afterValues[i])
 		}
-
 	}
+
+	return errors.Trace(r.makeUpdateLookupData(req.Data, rule, beforeValues, afterValues, lookups))
 }
 
 // If id in toml file is none, get primary keys in one row and format them into a string, and PK must not be nil
@@ -441,6 +611,11 @@ func (r *River) getDocID(rule *Rule, row []interface{}) (string, error) {
 		}
 	}
 
+	return formatDocID(ids)
+}
+
+// formatDocID joins the values with ":" as the doc id, the values must not be nil.
+func formatDocID(ids []interface{}) (string, error) {
 	var buf bytes.Buffer
 
 	sep := ""
@@ -465,26 +640,76 @@ func (r *River) getParentID(rule *Rule, row []interface{}, columnName string) (s
 	return fmt.Sprint(row[index]), nil
 }
 
-func (r *River) doBulk(reqs []*elastic.BulkRequest) error {
+// eventPosition returns the binlog position of the rows event, it is empty for the rows
+// dumped by mysqldump, which have no header.
+func (r *River) eventPosition(e *canal.RowsEvent) mysql.Position {
+	if e.Header == nil {
+		return mysql.Position{}
+	}
+	return mysql.Position{Name: r.binName, Pos: e.Header.LogPos}
+}
+
+// setPosition sets the binlog position of the change to the requests.
+func setPosition(reqs []*elastic.BulkRequest, pos mysql.Position) {
+	for _, req := range reqs {
+		req.BinName = pos.Name
+		req.BinPos = pos.Pos
+	}
+}
+
+// doBulk sends the requests to ES, and returns the items failed with a retryable status.
+// Other failed items are put into the dead letter queue directly.
+func (r *River) doBulk(reqs []*elastic.BulkRequest) ([]*bulkItemError, error) {
 	if len(reqs) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	if resp, err := r.es.Bulk(reqs); err != nil {
+	resp, err := r.es.Bulk(reqs)
+	if err != nil {
 		log.Errorf("sync docs err %v after binlog %s", err, r.canal.SyncedPosition())
-		return errors.Trace(err)
-	} else if resp.Code/100 == 2 || resp.Errors {
-		for i := 0; i < len(resp.Items); i++ {
-			for action, item := range resp.Items[i] {
-				if len(item.Error) > 0 {
-					log.Errorf("%s index: %s, type: %s, id: %s, status: %d, error: %s",
-						action, item.Index, item.Type, item.ID, item.Status, item.Error)
-				}
+		return nil, errors.Trace(err)
+	}
+
+	if resp.Code/100 != 2 {
+		return nil, errors.Trace(&bulkStatusError{resp.Code})
+	}
+
+	if !resp.Errors {
+		return nil, nil
+	}
+
+	var retries, fails []*bulkItemError
+	for i := 0; i < len(resp.Items) && i < len(reqs); i++ {
+		for action, item := range resp.Items[i] {
+			if len(item.Error) == 0 {
+				continue
+			}
+
+			if item.Status == http.StatusConflict && reqs[i].VersionType == elastic.VersionTypeExternal {
+				// a newer change is written before, e.g, retried or replayed from an old position
+				log.Warnf("ignore stale %s index: %s, type: %s, id: %s, version: %d", action, item.Index,
+					item.Type, item.ID, reqs[i].Version)
+				esStaleNum.WithLabelValues(item.Index).Inc()
+				continue
+			}
+
+			log.Errorf("%s index: %s, type: %s, id: %s, status: %d, error: %s",
+				action, item.Index, item.Type, item.ID, item.Status, item.Error)
+
+			e := &bulkItemError{req: reqs[i], status: item.Status, err: item.Error}
+			if isRetryableItemStatus(item.Status) {
+				retries = append(retries, e)
+			} else {
+				fails = append(fails, e)
 			}
 		}
 	}
 
-	return nil
+	if err = r.dlq.Put(fails); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return retries, nil
 }
 
 // get mysql field value and convert it to specific value to es
@@ -0,0 +1,224 @@
+package river
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+const (
+	externalVersionOff = "off"
+	// externalVersionPosition uses the index of the binlog file in the high 32 bits, and the position
+	// of the event in the low 32 bits, the binlog file names of the master must not be changed.
+	externalVersionPosition = "position"
+	// externalVersionGTID uses the sequence number of the transaction in the high 32 bits, and the position
+	// of the event in the low 32 bits, the transactions must be from one server UUID, or one MariaDB domain.
+	externalVersionGTID = "gtid"
+)
+
+// checkExternalVersion checks the config and the rules can use the external version.
+// The external version can't be used for the update action, so the rules must index the whole docs.
+func (r *River) checkExternalVersion() error {
+	switch r.c.ExternalVersion {
+	case externalVersionOff:
+		return nil
+	case externalVersionPosition:
+		if r.c.SnapshotMode == snapshotModeMysqldump && r.c.SkipMasterData {
+			return errors.Errorf("external version %s can't be used with mysqldump and skip_master_data", r.c.ExternalVersion)
+		}
+	case externalVersionGTID:
+		if r.c.CheckpointMode != checkpointModeGTID || r.c.SnapshotMode != snapshotModeNative {
+			return errors.Errorf("external version %s must be used with checkpoint mode %s and snapshot mode %s",
+				r.c.ExternalVersion, checkpointModeGTID, snapshotModeNative)
+		}
+	}
+
+	rules := make([]*Rule, 0, len(r.rules)+len(r.wildcards))
+	for _, rule := range r.rules {
+		rules = append(rules, rule)
+	}
+	for _, w := range r.wildcards {
+		if w.rule != nil {
+			rules = append(rules, w.rule)
+		}
+	}
+
+	for _, rule := range rules {
+		if rule.isNested() || r.hasNestedChildren(rule) {
+			return errors.Errorf("rule %s.%s can't use external version with the nested fields", rule.Schema, rule.Table)
+		}
+		if rule.WriteMode != writeModeIndex {
+			return errors.Errorf("rule %s.%s can't use external version with write_mode %s", rule.Schema, rule.Table,
+				rule.WriteMode)
+		}
+	}
+
+	return nil
+}
+
+func (r *River) isExternalVersion() bool {
+	return r.c.ExternalVersion == externalVersionPosition || r.c.ExternalVersion == externalVersionGTID
+}
+
+// setVersion sets the external version of the requests if enabled.
+func (r *River) setVersion(reqs []*elastic.BulkRequest, version int64) {
+	if !r.isExternalVersion() {
+		return
+	}
+
+	for _, req := range reqs {
+		req.Version = version
+		req.VersionType = elastic.VersionTypeExternal
+	}
+}
+
+// positionVersion returns the version of the binlog position, e.g, mysql-bin.000012, 154 is 12<<32 | 154.
+func positionVersion(pos mysql.Position) (int64, error) {
+	idx := strings.LastIndex(pos.Name, ".")
+	if idx < 0 {
+		return 0, errors.Errorf("invalid binlog file name %s for external version", pos.Name)
+	}
+
+	n, err := strconv.ParseUint(pos.Name[idx+1:], 10, 31)
+	if err != nil {
+		return 0, errors.Annotatef(err, "invalid binlog file name %s for external version", pos.Name)
+	}
+
+	return int64(n)<<32 | int64(pos.Pos), nil
+}
+
+// gtidSource returns the source of the transactions in gset and their max sequence number.
+// The source is the server UUID for MySQL, or the domain ID for MariaDB, whose sequence numbers
+// keep growing across the servers. The sequence numbers of different sources can't be compared,
+// so gset must have one source at most.
+func gtidSource(gset mysql.GTIDSet) (string, int64, error) {
+	var source string
+	var seq int64
+	switch s := gset.(type) {
+	case *mysql.MysqlGTIDSet:
+		if len(s.Sets) > 1 {
+			return "", 0, errors.Errorf("GTID set %s has more than one server UUID for external version", s)
+		}
+		for sid, set := range s.Sets {
+			source = sid
+			for _, interval := range set.Intervals {
+				if interval.Stop-1 > seq {
+					seq = interval.Stop - 1
+				}
+			}
+		}
+	case *mysql.MariadbGTIDSet:
+		if len(s.Sets) > 1 {
+			return "", 0, errors.Errorf("GTID set %s has more than one domain for external version", s)
+		}
+		for domain, gtid := range s.Sets {
+			source = strconv.FormatUint(uint64(domain), 10)
+			seq = int64(gtid.SequenceNumber)
+		}
+	}
+	return source, seq, nil
+}
+
+// gtidSetVersion returns the version greater than the events of all the transactions in gset.
+func gtidSetVersion(gset mysql.GTIDSet) (int64, error) {
+	_, seq, err := gtidSource(gset)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return seq<<32 | math.MaxUint32, nil
+}
+
+// setGTIDSource records the source of the GTID set which the binlog is synced from,
+// the versions of the later transactions are only comparable if they are from the same source.
+func (r *River) setGTIDSource(gset mysql.GTIDSet) error {
+	if r.c.ExternalVersion != externalVersionGTID {
+		return nil
+	}
+
+	source, _, err := gtidSource(gset)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	r.gtidSource = source
+	return nil
+}
+
+// checkGTIDSource checks the transaction is from the source of the synced GTID set. If not, e.g,
+// the master fails over to a server with a new UUID, the smaller sequence numbers make all the later
+// writes stale, so the sync must be stopped.
+func (r *River) checkGTIDSource(source string) error {
+	if r.c.ExternalVersion != externalVersionGTID {
+		return nil
+	}
+
+	if len(r.gtidSource) == 0 {
+		r.gtidSource = source
+	} else if source != r.gtidSource {
+		return errors.Errorf("GTID source is changed from %s to %s, the external versions can't be compared, "+
+			"rebuild the index or turn off external_version", r.gtidSource, source)
+	}
+	return nil
+}
+
+// snapshotVersion returns the version of the rows read at the binlog position and GTID set,
+// it is 0 if the external version is off.
+func (r *River) snapshotVersion(pos mysql.Position, gset mysql.GTIDSet) (int64, error) {
+	switch r.c.ExternalVersion {
+	case externalVersionPosition:
+		return positionVersion(pos)
+	case externalVersionGTID:
+		if gset == nil {
+			return 0, errors.Errorf("no GTID set for external version at %s", pos)
+		}
+		version, err := gtidSetVersion(gset)
+		return version, errors.Trace(err)
+	}
+	return 0, nil
+}
+
+// masterVersion returns the binlog position of the master, and the version of the rows read before.
+func (r *River) masterVersion() (mysql.Position, int64, error) {
+	var gset mysql.GTIDSet
+	var err error
+	if r.c.ExternalVersion == externalVersionGTID {
+		// get the GTID set before the position, so all the transactions in it are before the position
+		if gset, err = r.canal.GetMasterGTIDSet(); err != nil {
+			return mysql.Position{}, 0, errors.Trace(err)
+		}
+	}
+
+	pos, err := r.canal.GetMasterPos()
+	if err != nil {
+		return pos, 0, errors.Trace(err)
+	}
+
+	version, err := r.snapshotVersion(pos, gset)
+	return pos, version, errors.Trace(err)
+}
+
+// eventVersion returns the version of the rows event, it is 0 if the external version is off.
+// The rows dumped by mysqldump have no header, they use the master position before dumping,
+// because canal only knows the position of the dump after all the rows are parsed.
+func (r *River) eventVersion(e *canal.RowsEvent) (int64, error) {
+	if !r.isExternalVersion() {
+		return 0, nil
+	}
+
+	if e.Header == nil {
+		if r.dumpVersion == 0 {
+			return 0, errors.Errorf("no external version for the dumped rows of %s.%s", e.Table.Schema, e.Table.Name)
+		}
+		return r.dumpVersion, nil
+	}
+
+	if r.c.ExternalVersion == externalVersionGTID {
+		return r.gtidSeq<<32 | int64(e.Header.LogPos), nil
+	}
+
+	return positionVersion(r.eventPosition(e))
+}
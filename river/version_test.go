@@ -0,0 +1,174 @@
+package river
+
+import (
+	"math"
+	"testing"
+
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func TestPositionVersion(t *testing.T) {
+	version, err := positionVersion(mysql.Position{Name: "mysql-bin.000012", Pos: 154})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := int64(12)<<32 | 154; version != expect {
+		t.Errorf("Expected: %d, but: was %d", expect, version)
+	}
+
+	next, err := positionVersion(mysql.Position{Name: "mysql-bin.000013", Pos: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= version {
+		t.Errorf("Expected the version of the next binlog file greater than %d, but: was %d", version, next)
+	}
+
+	for _, name := range []string{"", "mysql-bin", "mysql-bin.abc"} {
+		if _, err = positionVersion(mysql.Position{Name: name, Pos: 4}); err == nil {
+			t.Errorf("Expected an error for binlog file %s", name)
+		}
+	}
+}
+
+func TestGTIDVersion(t *testing.T) {
+	gset, err := mysql.ParseMysqlGTIDSet("de278ad0-2106-11e4-9f8e-6edd0ca20947:1-10:12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, seq, err := gtidSource(gset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != "de278ad0-2106-11e4-9f8e-6edd0ca20947" || seq != 12 {
+		t.Errorf("Expected: de278ad0-2106-11e4-9f8e-6edd0ca20947 12, but: was %s %d", source, seq)
+	}
+	version, err := gtidSetVersion(gset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := int64(12)<<32 | math.MaxUint32; version != expect {
+		t.Errorf("Expected: %d, but: was %d", expect, version)
+	}
+
+	// the sequence numbers of the servers can't be compared
+	gset, err = mysql.ParseMysqlGTIDSet("de278ad0-2106-11e4-9f8e-6edd0ca20947:1-10,de278ad0-2106-11e4-9f8e-6edd0ca20948:1-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = gtidSetVersion(gset); err == nil {
+		t.Errorf("Expected an error for the GTID set of two servers")
+	}
+
+	gset, err = mysql.ParseMariadbGTIDSet("0-1-100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source, seq, err = gtidSource(gset); err != nil {
+		t.Fatal(err)
+	}
+	if source != "0" || seq != 100 {
+		t.Errorf("Expected: 0 100, but: was %s %d", source, seq)
+	}
+}
+
+func TestGTIDSourceChanged(t *testing.T) {
+	r := new(River)
+	r.c = &Config{ExternalVersion: externalVersionGTID}
+	h := &eventHandler{r}
+
+	gset, err := mysql.ParseMysqlGTIDSet("de278ad0-2106-11e4-9f8e-6edd0ca20947:1-10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.setGTIDSource(gset); err != nil {
+		t.Fatal(err)
+	}
+
+	gtid, err := mysql.ParseMysqlGTIDSet("de278ad0-2106-11e4-9f8e-6edd0ca20947:11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h.OnGTID(gtid); err != nil {
+		t.Fatal(err)
+	}
+	if r.gtidSeq != 11 {
+		t.Errorf("Expected: 11, but: was %d", r.gtidSeq)
+	}
+
+	// the master fails over to another server
+	if gtid, err = mysql.ParseMysqlGTIDSet("de278ad0-2106-11e4-9f8e-6edd0ca20948:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.OnGTID(gtid); err == nil {
+		t.Errorf("Expected an error for the changed GTID source")
+	}
+}
+
+func TestCheckExternalVersion(t *testing.T) {
+	r := new(River)
+	r.c = &Config{ExternalVersion: externalVersionPosition, CheckpointMode: checkpointModePosition,
+		SnapshotMode: snapshotModeNative}
+	r.rules = map[string]*Rule{"test:t": {Schema: "test", Table: "t", WriteMode: writeModeIndex}}
+
+	if err := r.checkExternalVersion(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := []*elastic.BulkRequest{{Action: elastic.ActionIndex}}
+	r.setVersion(reqs, 10)
+	if reqs[0].Version != 10 || reqs[0].VersionType != elastic.VersionTypeExternal {
+		t.Errorf("Expected the external version 10, but: was %+v", reqs[0])
+	}
+
+	r.c.ExternalVersion = externalVersionGTID
+	if err := r.checkExternalVersion(); err == nil {
+		t.Errorf("Expected an error for gtid without checkpoint mode gtid")
+	}
+
+	r.c.ExternalVersion = externalVersionPosition
+	r.rules["test:t"].WriteMode = writeModeUpsert
+	if err := r.checkExternalVersion(); err == nil {
+		t.Errorf("Expected an error for write_mode upsert")
+	}
+
+	r.c.ExternalVersion = externalVersionOff
+	reqs = []*elastic.BulkRequest{{Action: elastic.ActionIndex}}
+	r.setVersion(reqs, 10)
+	if len(reqs[0].VersionType) > 0 {
+		t.Errorf("Expected no version, but: was %+v", reqs[0])
+	}
+}
+
+func TestDumpVersion(t *testing.T) {
+	r := new(River)
+	r.c = &Config{ExternalVersion: externalVersionPosition, SnapshotMode: snapshotModeMysqldump}
+
+	// the rows dumped by mysqldump have no header
+	dumped := &canal.RowsEvent{Table: &schema.Table{Schema: "test", Name: "t"}, Action: canal.InsertAction}
+	if _, err := r.eventVersion(dumped); err == nil {
+		t.Errorf("Expected an error without the dump version")
+	}
+
+	r.dumpVersion = int64(12)<<32 | 154
+	version, err := r.eventVersion(dumped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != r.dumpVersion {
+		t.Errorf("Expected: %d, but: was %d", r.dumpVersion, version)
+	}
+
+	r.binName = "mysql-bin.000012"
+	dumped.Header = &replication.EventHeader{LogPos: 200}
+	if version, err = r.eventVersion(dumped); err != nil {
+		t.Fatal(err)
+	}
+	if version <= r.dumpVersion {
+		t.Errorf("Expected the version of the event after dumping greater than %d, but: was %d", r.dumpVersion, version)
+	}
+}
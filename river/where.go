@@ -0,0 +1,736 @@
+package river
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/parser"
+	"github.com/pingcap/parser/ast"
+	"github.com/pingcap/parser/format"
+	"github.com/pingcap/parser/opcode"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// rowFilter is the compiled where condition of the rule, like
+//
+//	status = 'published' AND deleted_at IS NULL
+//
+// It is parsed by the SQL parser, and supports AND, OR, NOT, the comparison operators
+// = != <> < <= > >= <=>, IS [NOT] NULL, IS [NOT] TRUE/FALSE, [NOT] IN, [NOT] LIKE and
+// [NOT] BETWEEN. The operands are columns and literals, arithmetic and functions are
+// not supported.
+//
+// Like SQL, a comparison with NULL is unknown, and the row matches only if the
+// condition is true. Strings are compared case insensitively like the default
+// collations of MySQL, the collation of the column is not used.
+type rowFilter struct {
+	expr whereNode
+	// columns are the column names used in the condition, the nodes refer to them by index,
+	// so the columns can be renamed by DDL without rebuilding the nodes.
+	columns []string
+}
+
+// whereResult is the three-valued logic result of the condition.
+type whereResult int8
+
+const (
+	whereFalse whereResult = iota
+	whereTrue
+	whereUnknown
+)
+
+func boolResult(b bool) whereResult {
+	if b {
+		return whereTrue
+	}
+	return whereFalse
+}
+
+// whereRow returns the value of the column with the index in rowFilter.columns.
+type whereRow func(idx int) interface{}
+
+type whereNode interface {
+	eval(row whereRow) whereResult
+}
+
+// whereOperand is a column or a literal.
+type whereOperand interface {
+	value(row whereRow) interface{}
+}
+
+type whereColumn int
+
+func (c whereColumn) value(row whereRow) interface{} {
+	return row(int(c))
+}
+
+type whereLiteral struct {
+	v interface{}
+}
+
+func (l whereLiteral) value(row whereRow) interface{} {
+	return l.v
+}
+
+type whereAnd struct {
+	left, right whereNode
+}
+
+func (n *whereAnd) eval(row whereRow) whereResult {
+	l := n.left.eval(row)
+	if l == whereFalse {
+		return whereFalse
+	}
+	r := n.right.eval(row)
+	if r == whereFalse {
+		return whereFalse
+	} else if l == whereUnknown || r == whereUnknown {
+		return whereUnknown
+	}
+	return whereTrue
+}
+
+type whereOr struct {
+	left, right whereNode
+}
+
+func (n *whereOr) eval(row whereRow) whereResult {
+	l := n.left.eval(row)
+	if l == whereTrue {
+		return whereTrue
+	}
+	r := n.right.eval(row)
+	if r == whereTrue {
+		return whereTrue
+	} else if l == whereUnknown || r == whereUnknown {
+		return whereUnknown
+	}
+	return whereFalse
+}
+
+type whereNot struct {
+	expr whereNode
+}
+
+func (n *whereNot) eval(row whereRow) whereResult {
+	switch n.expr.eval(row) {
+	case whereTrue:
+		return whereFalse
+	case whereFalse:
+		return whereTrue
+	}
+	return whereUnknown
+}
+
+type whereCompare struct {
+	op          opcode.Op
+	left, right whereOperand
+}
+
+func (n *whereCompare) eval(row whereRow) whereResult {
+	l, r := n.left.value(row), n.right.value(row)
+	if n.op == opcode.NullEQ && (l == nil || r == nil) {
+		return boolResult(l == nil && r == nil)
+	}
+
+	c, ok := compareWhereValues(l, r)
+	if !ok {
+		return whereUnknown
+	}
+
+	switch n.op {
+	case opcode.EQ, opcode.NullEQ:
+		return boolResult(c == 0)
+	case opcode.NE:
+		return boolResult(c != 0)
+	case opcode.LT:
+		return boolResult(c < 0)
+	case opcode.LE:
+		return boolResult(c <= 0)
+	case opcode.GT:
+		return boolResult(c > 0)
+	default:
+		return boolResult(c >= 0)
+	}
+}
+
+type whereIsNull struct {
+	expr whereOperand
+	not  bool
+}
+
+func (n *whereIsNull) eval(row whereRow) whereResult {
+	return boolResult((n.expr.value(row) == nil) != n.not)
+}
+
+type whereIn struct {
+	expr whereOperand
+	list []whereOperand
+	not  bool
+}
+
+func (n *whereIn) eval(row whereRow) whereResult {
+	v := n.expr.value(row)
+	if v == nil {
+		return whereUnknown
+	}
+
+	res := whereFalse
+	for _, item := range n.list {
+		c, ok := compareWhereValues(v, item.value(row))
+		if !ok {
+			res = whereUnknown
+		} else if c == 0 {
+			res = whereTrue
+			break
+		}
+	}
+
+	if n.not && res != whereUnknown {
+		return boolResult(res == whereFalse)
+	}
+	return res
+}
+
+type whereLike struct {
+	expr    whereOperand
+	pattern *regexp.Regexp
+	not     bool
+}
+
+func (n *whereLike) eval(row whereRow) whereResult {
+	v := n.expr.value(row)
+	if v == nil {
+		return whereUnknown
+	}
+	return boolResult(n.pattern.MatchString(whereString(v)) != n.not)
+}
+
+type whereBetween struct {
+	expr     whereOperand
+	low, top whereOperand
+	not      bool
+}
+
+func (n *whereBetween) eval(row whereRow) whereResult {
+	v := n.expr.value(row)
+	low, ok1 := compareWhereValues(v, n.low.value(row))
+	top, ok2 := compareWhereValues(v, n.top.value(row))
+	if !ok1 || !ok2 {
+		return whereUnknown
+	}
+	return boolResult((low >= 0 && top <= 0) != n.not)
+}
+
+// whereIsTruth is IS [NOT] TRUE or IS [NOT] FALSE, it is never unknown.
+type whereIsTruth struct {
+	expr  whereNode
+	truth bool
+	not   bool
+}
+
+func (n *whereIsTruth) eval(row whereRow) whereResult {
+	res := n.expr.eval(row)
+	return boolResult((res == boolResult(n.truth)) != n.not)
+}
+
+// whereTruth uses the operand as a condition, like MySQL, non-zero is true.
+type whereTruth struct {
+	expr whereOperand
+}
+
+func (n *whereTruth) eval(row whereRow) whereResult {
+	v := n.expr.value(row)
+	if v == nil {
+		return whereUnknown
+	}
+
+	f, ok := whereNumber(v)
+	if !ok {
+		// MySQL converts the string to a number, the non-numeric string is 0
+		f, _ = strconv.ParseFloat(strings.TrimSpace(whereString(v)), 64)
+	}
+	return boolResult(f != 0)
+}
+
+// whereNumber converts the numeric value to float64.
+func whereNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func whereString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// compareWhereValues compares the values, it is not ok if any value is NULL.
+// If one value is a number, the other is converted to a number too, like MySQL,
+// and the strings are compared case insensitively.
+func compareWhereValues(a interface{}, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+
+	fa, okA := whereNumber(a)
+	fb, okB := whereNumber(b)
+	if okA || okB {
+		if !okA {
+			fa, okA = parseWhereNumber(whereString(a))
+		}
+		if !okB {
+			fb, okB = parseWhereNumber(whereString(b))
+		}
+		if okA && okB {
+			switch {
+			case fa < fb:
+				return -1, true
+			case fa > fb:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	return strings.Compare(strings.ToLower(whereString(a)), strings.ToLower(whereString(b))), true
+}
+
+func parseWhereNumber(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return f, err == nil && !math.IsNaN(f)
+}
+
+// match checks whether the row of the table matches the condition.
+func (f *rowFilter) match(table *schema.Table, values []interface{}) bool {
+	row := func(idx int) interface{} {
+		i := findColumn(table, f.columns[idx])
+		if i < 0 || i >= len(values) {
+			// the column may be dropped
+			return nil
+		}
+		return whereColumnValue(&table.Columns[i], values[i])
+	}
+
+	return f.expr.eval(row) == whereTrue
+}
+
+// findColumn finds the column case insensitively like MySQL.
+func findColumn(table *schema.Table, name string) int {
+	if i := table.FindColumn(name); i >= 0 {
+		return i
+	}
+	for i, c := range table.Columns {
+		if strings.EqualFold(c.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// whereColumnValue converts the binlog value to the value used in the condition,
+// ENUM and SET are the strings but not the indexes.
+func whereColumnValue(col *schema.TableColumn, value interface{}) interface{} {
+	switch col.Type {
+	case schema.TYPE_ENUM:
+		if v, ok := value.(int64); ok {
+			if v < 1 || v > int64(len(col.EnumValues)) {
+				return ""
+			}
+			return col.EnumValues[v-1]
+		}
+	case schema.TYPE_SET:
+		if v, ok := value.(int64); ok {
+			sets := make([]string, 0, len(col.SetValues))
+			for i, s := range col.SetValues {
+				if v&int64(1<<uint(i)) > 0 {
+					sets = append(sets, s)
+				}
+			}
+			return strings.Join(sets, ",")
+		}
+	}
+
+	if v, ok := value.([]byte); ok {
+		return string(v)
+	}
+	return value
+}
+
+// checkColumns checks whether the columns in the condition exist in the table.
+func (f *rowFilter) checkColumns(table *schema.Table) error {
+	for _, c := range f.columns {
+		if findColumn(table, c) < 0 {
+			return errors.Errorf("unknown column %s in where of %s.%s", c, table.Schema, table.Name)
+		}
+	}
+	return nil
+}
+
+// renameColumn returns a copy of the filter with the column renamed.
+func (f *rowFilter) renameColumn(oldName string, newName string) *rowFilter {
+	nf := &rowFilter{expr: f.expr, columns: make([]string, len(f.columns))}
+	for i, c := range f.columns {
+		if strings.EqualFold(c, oldName) {
+			c = newName
+		}
+		nf.columns[i] = c
+	}
+	return nf
+}
+
+// parseWhere compiles the where condition, it is parsed as the where clause of a select statement.
+func parseWhere(where string) (*rowFilter, error) {
+	stmts, _, err := parser.New().Parse("SELECT 1 FROM t WHERE "+where, "", "")
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid where %s", where)
+	}
+
+	// the condition must not end the where clause, e.g, id = 1 LIMIT 1, or id = 1; DELETE FROM t
+	sel, ok := stmts[0].(*ast.SelectStmt)
+	if len(stmts) != 1 || !ok || sel.Where == nil || sel.GroupBy != nil || sel.Having != nil ||
+		sel.WindowSpecs != nil || sel.OrderBy != nil || sel.Limit != nil || sel.LockTp != ast.SelectLockNone {
+		return nil, errors.Errorf("invalid where %s, only the condition is allowed", where)
+	}
+
+	f := new(rowFilter)
+	if f.expr, err = f.compile(sel.Where); err != nil {
+		return nil, errors.Annotatef(err, "invalid where %s", where)
+	}
+	return f, nil
+}
+
+// compile converts the condition expression to the node.
+func (f *rowFilter) compile(expr ast.ExprNode) (whereNode, error) {
+	switch e := expr.(type) {
+	case *ast.ParenthesesExpr:
+		return f.compile(e.Expr)
+	case *ast.BinaryOperationExpr:
+		switch e.Op {
+		case opcode.LogicAnd, opcode.LogicOr:
+			left, err := f.compile(e.L)
+			if err != nil {
+				return nil, err
+			}
+			right, err := f.compile(e.R)
+			if err != nil {
+				return nil, err
+			}
+			if e.Op == opcode.LogicAnd {
+				return &whereAnd{left, right}, nil
+			}
+			return &whereOr{left, right}, nil
+		case opcode.EQ, opcode.NE, opcode.LT, opcode.LE, opcode.GT, opcode.GE, opcode.NullEQ:
+			left, err := f.operand(e.L)
+			if err != nil {
+				return nil, err
+			}
+			right, err := f.operand(e.R)
+			if err != nil {
+				return nil, err
+			}
+			return &whereCompare{op: e.Op, left: left, right: right}, nil
+		}
+	case *ast.UnaryOperationExpr:
+		if e.Op == opcode.Not {
+			n, err := f.compile(e.V)
+			if err != nil {
+				return nil, err
+			}
+			return &whereNot{n}, nil
+		}
+	case *ast.IsNullExpr:
+		n, err := f.operand(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return &whereIsNull{expr: n, not: e.Not}, nil
+	case *ast.IsTruthExpr:
+		n, err := f.compile(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return &whereIsTruth{expr: n, truth: e.True != 0, not: e.Not}, nil
+	case *ast.PatternInExpr:
+		if e.Sel != nil {
+			break
+		}
+		n := &whereIn{not: e.Not}
+		var err error
+		if n.expr, err = f.operand(e.Expr); err != nil {
+			return nil, err
+		}
+		for _, item := range e.List {
+			op, err := f.operand(item)
+			if err != nil {
+				return nil, err
+			}
+			n.list = append(n.list, op)
+		}
+		return n, nil
+	case *ast.PatternLikeExpr:
+		v, ok := e.Pattern.(*whereValueExpr)
+		if !ok {
+			return nil, errors.Errorf("LIKE must be followed by a string")
+		}
+		pattern, ok := v.val.(string)
+		if !ok {
+			return nil, errors.Errorf("LIKE must be followed by a string")
+		}
+		n, err := f.operand(e.Expr)
+		if err != nil {
+			return nil, err
+		}
+		return &whereLike{expr: n, pattern: likePattern(pattern, e.Escape), not: e.Not}, nil
+	case *ast.BetweenExpr:
+		n := &whereBetween{not: e.Not}
+		var err error
+		if n.expr, err = f.operand(e.Expr); err != nil {
+			return nil, err
+		}
+		if n.low, err = f.operand(e.Left); err != nil {
+			return nil, err
+		}
+		if n.top, err = f.operand(e.Right); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+
+	// use the column or literal as a condition
+	n, err := f.operand(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &whereTruth{n}, nil
+}
+
+// operand converts the expression to a column or a literal.
+func (f *rowFilter) operand(expr ast.ExprNode) (whereOperand, error) {
+	switch e := expr.(type) {
+	case *ast.ParenthesesExpr:
+		return f.operand(e.Expr)
+	case *ast.ColumnNameExpr:
+		name := e.Name.Name.O
+		for i, c := range f.columns {
+			if strings.EqualFold(c, name) {
+				return whereColumn(i), nil
+			}
+		}
+		f.columns = append(f.columns, name)
+		return whereColumn(len(f.columns) - 1), nil
+	case *whereValueExpr:
+		v, err := e.literal()
+		if err != nil {
+			return nil, err
+		}
+		return whereLiteral{v}, nil
+	case *ast.UnaryOperationExpr:
+		if e.Op != opcode.Minus && e.Op != opcode.Plus {
+			break
+		}
+		n, err := f.operand(e.V)
+		if err != nil {
+			return nil, err
+		}
+		l, ok := n.(whereLiteral)
+		if !ok {
+			break
+		}
+		v, ok := whereNumber(l.v)
+		if !ok {
+			break
+		}
+		if e.Op == opcode.Plus {
+			return l, nil
+		}
+		if i, ok := l.v.(int64); ok {
+			return whereLiteral{-i}, nil
+		}
+		return whereLiteral{-v}, nil
+	}
+
+	return nil, errors.Errorf("unsupported expression %s, only columns and literals can be used", restoreExpr(expr))
+}
+
+func restoreExpr(expr ast.ExprNode) string {
+	var buf bytes.Buffer
+	if err := expr.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags, &buf)); err != nil {
+		return fmt.Sprintf("%T", expr)
+	}
+	return buf.String()
+}
+
+// likePattern converts the LIKE pattern to a regexp, % matches any characters and _ matches one,
+// the strings are matched case insensitively.
+func likePattern(pattern string, escape byte) *regexp.Regexp {
+	var buf bytes.Buffer
+	buf.WriteString("(?is)^")
+	escaped := false
+	for _, ch := range pattern {
+		switch {
+		case escaped:
+			buf.WriteString(regexp.QuoteMeta(string(ch)))
+			escaped = false
+		case ch == rune(escape):
+			escaped = true
+		case ch == '%':
+			buf.WriteString(".*")
+		case ch == '_':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	if escaped {
+		// the escape character at the end matches itself
+		buf.WriteString(regexp.QuoteMeta(string(escape)))
+	}
+	buf.WriteString("$")
+	return regexp.MustCompile(buf.String())
+}
+
+// canal registers a parser driver which drops the literal values because it only parses DDL,
+// so register the driver keeping the values for the where condition, canal works with it too.
+func init() {
+	ast.NewValueExpr = newWhereValueExpr
+	ast.NewDecimal = func(s string) (interface{}, error) {
+		return whereDecimal(s), nil
+	}
+	ast.NewHexLiteral = func(s string) (interface{}, error) {
+		return whereBinaryLiteral(s), nil
+	}
+	ast.NewBitLiteral = func(s string) (interface{}, error) {
+		return whereBinaryLiteral(s), nil
+	}
+}
+
+// whereDecimal is the decimal literal.
+type whereDecimal string
+
+// whereBinaryLiteral is the hex or bit literal, which is not supported in the where condition.
+type whereBinaryLiteral string
+
+// whereValueExpr is the literal in the parsed SQL.
+type whereValueExpr struct {
+	ast.TexprNode
+	val    interface{}
+	offset int
+}
+
+func newWhereValueExpr(val interface{}) ast.ValueExpr {
+	return &whereValueExpr{val: val, offset: -1}
+}
+
+// literal returns the value used in the condition.
+func (e *whereValueExpr) literal() (interface{}, error) {
+	switch v := e.val.(type) {
+	case bool:
+		if v {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case whereDecimal:
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid number %s", v)
+		}
+		return f, nil
+	case whereBinaryLiteral:
+		return nil, errors.Errorf("unsupported literal %s", v)
+	}
+	return e.val, nil
+}
+
+func (e *whereValueExpr) SetValue(val interface{}) {
+	e.val = val
+}
+
+func (e *whereValueExpr) GetValue() interface{} {
+	return e.val
+}
+
+func (e *whereValueExpr) GetDatumString() string {
+	return whereString(e.val)
+}
+
+func (e *whereValueExpr) GetString() string {
+	s, _ := e.val.(string)
+	return s
+}
+
+func (e *whereValueExpr) GetProjectionOffset() int {
+	return e.offset
+}
+
+func (e *whereValueExpr) SetProjectionOffset(offset int) {
+	e.offset = offset
+}
+
+func (e *whereValueExpr) Restore(ctx *format.RestoreCtx) error {
+	switch v := e.val.(type) {
+	case nil:
+		ctx.WriteKeyWord("NULL")
+	case bool:
+		if v {
+			ctx.WriteKeyWord("TRUE")
+		} else {
+			ctx.WriteKeyWord("FALSE")
+		}
+	case string:
+		ctx.WriteString(v)
+	default:
+		ctx.WritePlain(whereString(v))
+	}
+	return nil
+}
+
+func (e *whereValueExpr) Accept(v ast.Visitor) (ast.Node, bool) {
+	// no children
+	newNode, _ := v.Enter(e)
+	return v.Leave(newNode)
+}
+
+func (e *whereValueExpr) Format(w io.Writer) {
+	fmt.Fprint(w, whereString(e.val))
+}
@@ -0,0 +1,138 @@
+package river
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func newTestWhereTable() *schema.Table {
+	table := &schema.Table{Schema: "test", Name: "test_river"}
+	table.AddColumn("id", "int(11)", "", "")
+	table.AddColumn("status", "enum('draft','published')", "", "")
+	table.AddColumn("title", "varchar(256)", "", "")
+	table.AddColumn("score", "double", "", "")
+	table.AddColumn("deleted_at", "datetime", "", "")
+	table.PKColumns = []int{0}
+	return table
+}
+
+func TestWhere(t *testing.T) {
+	table := newTestWhereTable()
+	published := []interface{}{int64(1), int64(2), []byte("Hello world"), float64(4.5), nil}
+	draft := []interface{}{int64(2), int64(1), "it's", float64(1), "2019-01-01 00:00:00"}
+
+	tests := []struct {
+		Where string
+		Match []bool
+	}{
+		{"status = 'published' AND deleted_at IS NULL", []bool{true, false}},
+		{"status != 'published' OR `deleted_at` IS NOT NULL", []bool{false, true}},
+		{"NOT (status = 'published')", []bool{false, true}},
+		{"id IN (1, 3)", []bool{true, false}},
+		{"id NOT IN (1, 3)", []bool{false, true}},
+		{"title LIKE 'Hello%'", []bool{true, false}},
+		{"title NOT LIKE '%o_ld'", []bool{false, true}},
+		{"title = 'it''s'", []bool{false, true}},
+		{"score BETWEEN 1 AND 4", []bool{false, true}},
+		{"score > 1.5 && id >= '1'", []bool{true, false}},
+		{"deleted_at > '2018-12-31'", []bool{false, true}},
+		// NULL is unknown
+		{"deleted_at = NULL", []bool{false, false}},
+		{"NOT deleted_at < '2020-01-01'", []bool{false, false}},
+		{"id", []bool{true, true}},
+		{"ID = 2", []bool{false, true}},
+		{"(status) = 'published'", []bool{true, false}},
+		{"title = 'HELLO world' OR title LIKE 'IT%'", []bool{true, true}},
+		{"deleted_at <=> NULL", []bool{true, false}},
+		{"(deleted_at = NULL) IS NOT TRUE", []bool{true, true}},
+		{"score > -1.5 AND id < +3", []bool{true, true}},
+		{"status IN ('Draft') AND title NOT LIKE '%\\%'", []bool{false, true}},
+	}
+
+	for _, test := range tests {
+		f, err := parseWhere(test.Where)
+		if err != nil {
+			t.Errorf("Where: %s, err %v", test.Where, err)
+			continue
+		}
+		if err = f.checkColumns(table); err != nil {
+			t.Errorf("Where: %s, err %v", test.Where, err)
+			continue
+		}
+
+		for i, row := range [][]interface{}{published, draft} {
+			if m := f.match(table, row); m != test.Match[i] {
+				t.Errorf("Where: %s, row %d, Expected: %v, but: was %v", test.Where, i, test.Match[i], m)
+			}
+		}
+	}
+
+	for _, where := range []string{"", "status =", "status = 'a", "(id = 1", "id NOT 1", "id LIKE 1", "id = 1 2",
+		"id = 1 LIMIT 1", "id = 1; DELETE FROM t", "id + 1 = 2", "id IN (SELECT 1)", "id = x'01'", "length(title) > 1"} {
+		if _, err := parseWhere(where); err == nil {
+			t.Errorf("Where: %s, Expected error", where)
+		}
+	}
+
+	f, _ := parseWhere("unknown = 1")
+	if err := f.checkColumns(table); err == nil {
+		t.Errorf("Expected unknown column error")
+	}
+
+	// the renamed column
+	f, _ = parseWhere("title LIKE 'Hello%'")
+	f = f.renameColumn("title", "name")
+	table.Columns[2].Name = "name"
+	if !f.match(table, published) {
+		t.Errorf("Expected the renamed column matches")
+	}
+}
+
+func TestWhereUpdate(t *testing.T) {
+	r := newTestSnapshotRiver()
+	rule := &Rule{Schema: "test", Table: "test_river", Index: "river", Type: "river", Where: "status = 'published'"}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	rule.TableInfo = newTestWhereTable()
+
+	draft := []interface{}{int64(1), int64(1), "a", float64(1), nil}
+	published := []interface{}{int64(1), int64(2), "a", float64(1), nil}
+	changed := []interface{}{int64(1), int64(2), "b", float64(1), nil}
+
+	tests := []struct {
+		Before []interface{}
+		After  []interface{}
+		Action string
+	}{
+		{draft, published, elastic.ActionIndex},
+		{published, draft, elastic.ActionDelete},
+		{published, changed, elastic.ActionUpdate},
+		{draft, draft, ""},
+	}
+
+	for i, test := range tests {
+		reqs, err := r.makeUpdateRequest(rule, [][]interface{}{test.Before, test.After}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(test.Action) == 0 {
+			if len(reqs) != 0 {
+				t.Errorf("Test %d, Expected no request, but: was %v", i, reqs)
+			}
+		} else if len(reqs) != 1 || reqs[0].Action != test.Action {
+			t.Errorf("Test %d, Expected: %s, but: was %v", i, test.Action, reqs)
+		}
+	}
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{draft, published})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 {
+		t.Errorf("Expected only the published row is inserted, but: was %d", len(reqs))
+	}
+}
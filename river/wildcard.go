@@ -0,0 +1,145 @@
+package river
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql/canal"
+	mysqlschema "github.com/siddontang/go-mysql/schema"
+)
+
+// wildcardRule is the wildcard table in source, the tables created later
+// which match it are synced with the rule too.
+type wildcardRule struct {
+	schema string
+	table  string
+	reg    *regexp.Regexp
+
+	// rule is the wildcard rule in config, nil to use the default rule.
+	rule *Rule
+}
+
+func newWildcardRule(schema string, table string) (*wildcardRule, error) {
+	reg, err := regexp.Compile("(?i)^" + buildTable(table) + "$")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &wildcardRule{schema: schema, table: table, reg: reg}, nil
+}
+
+func (w *wildcardRule) match(schema string, table string) bool {
+	return strings.EqualFold(w.schema, schema) && w.reg.MatchString(table)
+}
+
+// newRule creates the rule of the table which matches the wildcard table.
+func (w *wildcardRule) newRule(table string) *Rule {
+	rule := newDefaultRule(w.schema, table)
+	if w.rule != nil {
+		inheritWildcardRule(rule, w.rule)
+	}
+	return rule
+}
+
+// inheritWildcardRule copies the settings of the wildcard rule to the rule of the table.
+func inheritWildcardRule(rule *Rule, wildcard *Rule) {
+	rule.Index = wildcard.Index
+	rule.Type = wildcard.Type
+	rule.Parent = wildcard.Parent
+	rule.ID = wildcard.ID
+	rule.FieldMapping = wildcard.FieldMapping
+	rule.Filter = wildcard.Filter
+	rule.Exclude = wildcard.Exclude
+	rule.IncludeRegex = wildcard.IncludeRegex
+	rule.ExcludeRegex = wildcard.ExcludeRegex
+	rule.includeRegex = wildcard.includeRegex
+	rule.excludeRegex = wildcard.excludeRegex
+	rule.NestedField = wildcard.NestedField
+	rule.NestedParentID = wildcard.NestedParentID
+	rule.NestedKey = wildcard.NestedKey
+	rule.Where = wildcard.Where
+	rule.rowFilter = wildcard.rowFilter
+	rule.DDLAddColumn = wildcard.DDLAddColumn
+	rule.DDLRenameColumn = wildcard.DDLRenameColumn
+	rule.DDLDropTable = wildcard.DDLDropTable
+	rule.DDLTruncateTable = wildcard.DDLTruncateTable
+	rule.Lookups = wildcard.Lookups
+	rule.WriteMode = wildcard.WriteMode
+	rule.AutoMapping = wildcard.AutoMapping
+	rule.Mapping = wildcard.Mapping
+}
+
+// addWildcardTable adds the rule for the table created or renamed at runtime if it matches a wildcard table.
+// It returns ErrRuleNotExist if the table doesn't match any wildcard table.
+func (r *River) addWildcardTable(schema string, table string) error {
+	if _, ok := r.rules[ruleKey(schema, table)]; ok {
+		return nil
+	}
+
+	var w *wildcardRule
+	for _, v := range r.wildcards {
+		if v.match(schema, table) {
+			w = v
+			break
+		}
+	}
+	if w == nil {
+		return ErrRuleNotExist
+	}
+
+	tableInfo, err := r.canal.GetTable(schema, table)
+	if cause := errors.Cause(err); cause == mysqlschema.ErrTableNotExist || cause == canal.ErrExcludedTable {
+		// the table may be dropped later when we replay the binlog
+		log.Infof("ignore table %s.%s, err %v", schema, table, err)
+		return nil
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(r.addWildcardRule(w, tableInfo))
+}
+
+// addWildcardRule adds the rule of the wildcard table for the table, with the same checks as startup.
+func (r *River) addWildcardRule(w *wildcardRule, tableInfo *mysqlschema.Table) error {
+	if len(tableInfo.PKColumns) == 0 {
+		if !r.c.SkipNoPkTable {
+			return errors.Errorf("%s.%s must have a PK for a column", tableInfo.Schema, tableInfo.Name)
+		}
+
+		log.Errorf("ignored table without a primary key: %s\n", tableInfo.Name)
+		return nil
+	}
+
+	// use the table name in MySQL, the name in DDL may be in different case
+	rule := w.newRule(tableInfo.Name)
+	rule.Schema = tableInfo.Schema
+	rule.TableInfo = tableInfo
+	if rule.rowFilter != nil {
+		// otherwise the condition is unknown for every row, and nothing is synced
+		if err := rule.rowFilter.checkColumns(tableInfo); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	r.prepareColumns(rule)
+	if err := r.addLookupRefs(rule); err != nil {
+		return errors.Trace(err)
+	}
+
+	r.rulesLock.Lock()
+	r.rules[ruleKey(rule.Schema, rule.Table)] = rule
+	r.rulesLock.Unlock()
+
+	log.Infof("table %s.%s matches wildcard table %s.%s, sync it to index %s", rule.Schema, rule.Table,
+		w.schema, w.table, rule.Index)
+
+	if !rule.AutoMapping {
+		return nil
+	}
+
+	index, docType, mapping := rule.Index, rule.Type, r.ruleMapping(rule)
+	return r.sendTask(func() error {
+		return errors.Trace(r.es.CreateMapping(index, docType, mapping))
+	})
+}
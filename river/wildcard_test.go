@@ -0,0 +1,92 @@
+package river
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func TestWildcardRule(t *testing.T) {
+	w, err := newWildcardRule("test", "test_river_[0-9]{4}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Schema string
+		Table  string
+		Match  bool
+	}{
+		{"test", "test_river_1024", true},
+		{"TEST", "Test_River_1024", true},
+		{"test", "test_river_10240", false},
+		{"test", "test_river", false},
+		{"other", "test_river_1024", false},
+	}
+
+	for _, test := range tests {
+		if w.match(test.Schema, test.Table) != test.Match {
+			t.Errorf("Table: %s.%s, Expected match: %v", test.Schema, test.Table, test.Match)
+		}
+	}
+
+	rule := w.newRule("test_river_1024")
+	if rule.Index != "test_river_1024" {
+		t.Errorf("Expected default index test_river_1024, but: was %s", rule.Index)
+	}
+
+	w.rule = &Rule{Schema: "test", Table: "test_river_[0-9]{4}", Index: "river", Type: "_doc",
+		ID: []string{"id"}, FieldMapping: map[string]string{"title": "es_title"}, DDLDropTable: ddlDeleteIndex}
+	rule = w.newRule("test_river_1024")
+	if rule.Table != "test_river_1024" || rule.Index != "river" || rule.Type != "_doc" ||
+		!reflect.DeepEqual(rule.ID, []string{"id"}) || rule.FieldMapping["title"] != "es_title" ||
+		rule.DDLDropTable != ddlDeleteIndex {
+		t.Errorf("Expected the wildcard rule is inherited, but: was %+v", rule)
+	}
+
+	r := newTestSnapshotRiver()
+	r.wildcards = []*wildcardRule{w}
+	if err = r.addWildcardTable("test", "other"); err != ErrRuleNotExist {
+		t.Errorf("Expected ErrRuleNotExist, but: was %v", err)
+	}
+	// the table has the rule already
+	if err = r.addWildcardTable("test", "test_river_0000"); err != nil {
+		t.Errorf("Expected no error, but: was %v", err)
+	}
+}
+
+func TestWildcardRuleWhereColumns(t *testing.T) {
+	w, err := newWildcardRule("test", "test_river_[0-9]{4}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.rule = &Rule{Schema: "test", Table: "test_river_[0-9]{4}", Index: "river", Type: "_doc",
+		Where: "status = 'published'"}
+	if err = w.rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestSnapshotRiver()
+	r.lookups = make(map[string][]lookupRef)
+
+	// the new shard misses the column of the where condition
+	table := &schema.Table{Schema: "test", Name: "test_river_1024"}
+	table.AddColumn("id", "int(11)", "", "")
+	table.AddColumn("title", "varchar(256)", "", "")
+	table.PKColumns = []int{0}
+	if err = r.addWildcardRule(w, table); err == nil {
+		t.Errorf("Expected an error for the unknown column status")
+	}
+	if _, ok := r.rules[ruleKey("test", "test_river_1024")]; ok {
+		t.Errorf("Expected the rule not added")
+	}
+
+	table.AddColumn("status", "varchar(16)", "", "")
+	if err = r.addWildcardRule(w, table); err != nil {
+		t.Fatal(err)
+	}
+	if rule := r.rules[ruleKey("test", "test_river_1024")]; rule == nil || !rule.MatchRow([]interface{}{int64(1), "a", "published"}) {
+		t.Errorf("Expected the rule with the where condition, but: was %+v", rule)
+	}
+}
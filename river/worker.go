@@ -0,0 +1,157 @@
+package river
+
+import (
+	"hash/fnv"
+	"time"
+
+	"github.com/siddontang/go-log/log"
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+// flushBarrier asks the bulk worker to flush all the pending requests,
+// the worker sends the result to done after flushing.
+type flushBarrier struct {
+	done chan error
+}
+
+// bulkWorker sends the bulk requests to ES in its own goroutine. The requests
+// for the same document are always dispatched to the same worker, so they are
+// sent in order.
+type bulkWorker struct {
+	r *River
+
+	ch chan interface{}
+
+	bulkSize int
+	interval time.Duration
+}
+
+func (r *River) newBulkWorkers(bulkSize int, interval time.Duration) []*bulkWorker {
+	n := r.c.BulkWorkers
+	if n <= 0 {
+		n = 1
+	}
+
+	workers := make([]*bulkWorker, n)
+	for i := range workers {
+		workers[i] = &bulkWorker{
+			r:        r,
+			ch:       make(chan interface{}, 1024),
+			bulkSize: bulkSize,
+			interval: interval,
+		}
+	}
+	return workers
+}
+
+func (w *bulkWorker) run() {
+	r := w.r
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	reqs := make([]*elastic.BulkRequest, 0, 1024)
+
+	for {
+		needFlush := false
+		var barrier *flushBarrier
+
+		select {
+		case v := <-w.ch:
+			switch v := v.(type) {
+			case []*elastic.BulkRequest:
+				reqs = append(reqs, v...)
+				needFlush = len(reqs) >= w.bulkSize
+			case flushBarrier:
+				needFlush = true
+				barrier = &v
+			}
+		case <-ticker.C:
+			needFlush = true
+		case <-r.ctx.Done():
+			return
+		}
+
+		if needFlush && len(reqs) > 0 {
+			if err := r.doBulkWithRetry(reqs); err != nil {
+				log.Errorf("do ES bulk err %v, close sync", err)
+				r.cancel()
+				if barrier != nil {
+					barrier.done <- err
+				}
+				return
+			}
+			reqs = reqs[0:0]
+		}
+
+		if barrier != nil {
+			barrier.done <- nil
+		}
+	}
+}
+
+// send sends v to the worker, returns false if the river is closed.
+func (w *bulkWorker) send(v interface{}) bool {
+	select {
+	case w.ch <- v:
+		return true
+	case <-w.r.ctx.Done():
+		return false
+	}
+}
+
+// dispatch hashes the requests by index and ID to the workers.
+func dispatch(workers []*bulkWorker, reqs []*elastic.BulkRequest) bool {
+	if len(workers) == 1 {
+		return workers[0].send(reqs)
+	}
+
+	parts := make([][]*elastic.BulkRequest, len(workers))
+	for _, req := range reqs {
+		i := workerIndex(req, len(workers))
+		parts[i] = append(parts[i], req)
+	}
+
+	for i, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		if !workers[i].send(part) {
+			return false
+		}
+	}
+	return true
+}
+
+func workerIndex(req *elastic.BulkRequest, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(req.Index))
+	h.Write([]byte{0})
+	h.Write([]byte(req.ID))
+	return int(h.Sum32() % uint32(n))
+}
+
+// flushWorkers waits for all the workers to flush the requests received before,
+// returns false if any worker fails or the river is closed.
+func flushWorkers(workers []*bulkWorker) bool {
+	done := make(chan error, len(workers))
+	for _, w := range workers {
+		if !w.send(flushBarrier{done: done}) {
+			return false
+		}
+	}
+
+	ctx := workers[0].r.ctx
+	for range workers {
+		select {
+		case err := <-done:
+			if err != nil {
+				return false
+			}
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
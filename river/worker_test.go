@@ -0,0 +1,92 @@
+package river
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+func TestBulkWorkers(t *testing.T) {
+	var m sync.Mutex
+	docs := make(map[string][]float64)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+
+		var id string
+		s := bufio.NewScanner(req.Body)
+		for i := 0; s.Scan(); i++ {
+			var v map[string]interface{}
+			json.Unmarshal(s.Bytes(), &v)
+			if i%2 == 0 {
+				id = v["index"].(map[string]interface{})["_id"].(string)
+			} else {
+				docs[id] = append(docs[id], v["seq"].(float64))
+			}
+		}
+		w.Write([]byte(`{"errors": false, "items": []}`))
+	}))
+	defer server.Close()
+
+	r := new(River)
+	r.c = &Config{BulkWorkers: 4}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.bulkRetry = newBulkRetryPolicy(r.c)
+	r.es = elastic.NewClient(&elastic.ClientConfig{Addr: strings.TrimPrefix(server.URL, "http://"), Version: "7.10.2"})
+	defer r.es.Close()
+
+	workers := r.newBulkWorkers(8, time.Hour)
+	for _, w := range workers {
+		r.wg.Add(1)
+		go w.run()
+	}
+
+	for seq := 0; seq < 20; seq++ {
+		var reqs []*elastic.BulkRequest
+		for id := 0; id < 10; id++ {
+			reqs = append(reqs, &elastic.BulkRequest{
+				Action: elastic.ActionIndex,
+				Index:  "test",
+				ID:     fmt.Sprintf("%d", id),
+				Data:   map[string]interface{}{"seq": seq},
+			})
+		}
+		if !dispatch(workers, reqs) {
+			t.Fatal("dispatch failed")
+		}
+	}
+
+	if !flushWorkers(workers) {
+		t.Fatal("flush workers failed")
+	}
+
+	m.Lock()
+	if len(docs) != 10 {
+		t.Errorf("Expected: 10 docs, but: was %d", len(docs))
+	}
+	for id, seqs := range docs {
+		if len(seqs) != 20 {
+			t.Errorf("Doc: %s, Expected: 20 requests, but: was %d", id, len(seqs))
+		}
+		for i, seq := range seqs {
+			if int(seq) != i {
+				t.Errorf("Doc: %s, Expected: seq %d, but: was %v", id, i, seq)
+				break
+			}
+		}
+	}
+	m.Unlock()
+
+	r.cancel()
+	r.wg.Wait()
+}
@@ -0,0 +1,120 @@
+package river
+
+import (
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+)
+
+const (
+	// writeModeIndex indexes the whole doc for the inserted rows, and updates the changed fields, it is the default mode.
+	writeModeIndex = "index"
+	// writeModeMerge writes only the fields of the table into the doc, which may be shared with other tables,
+	// and removes them when the row is deleted.
+	writeModeMerge = "merge"
+	// writeModeUpsert updates the doc with all the fields of the updated row and doc_as_upsert,
+	// so the doc missing in ES is created again instead of failing the update.
+	writeModeUpsert = "upsert"
+)
+
+// mergeScript removes the fields of the table from the doc, and deletes the doc if only the fields
+// shared with other tables are left. The doc is not created if it doesn't exist.
+const mergeScript = `if (ctx._source.isEmpty()) {
+  ctx.op = 'none';
+} else {
+  for (field in params.fields) {
+    ctx._source.remove(field);
+  }
+  if (params.shared.containsAll(ctx._source.keySet())) {
+    ctx.op = 'delete';
+  }
+}`
+
+// isMerged checks whether the rows of the rule are merged into the docs shared with other tables.
+func (r *Rule) isMerged() bool {
+	return r.WriteMode == writeModeMerge
+}
+
+// upsertDoc changes the index request of the updated row to update the doc with all the fields,
+// the doc is created if it doesn't exist.
+func upsertDoc(req *elastic.BulkRequest) {
+	req.Action = elastic.ActionUpdate
+	req.DocAsUpsert = true
+}
+
+// keepOtherFields changes the index request of the row to update the doc, so the fields synced
+// by other rules are kept, e.g, the nested fields built from the child rows, or the fields merged
+// from other tables. The doc is created if it doesn't exist.
+func (r *River) keepOtherFields(rule *Rule, req *elastic.BulkRequest) {
+	if req.Action == elastic.ActionIndex && (rule.isMerged() || r.hasNestedChildren(rule)) {
+		upsertDoc(req)
+	}
+}
+
+// removeMergedFields changes the delete request of the merged row to remove only the fields of the rule.
+func (r *River) removeMergedFields(rule *Rule, req *elastic.BulkRequest) {
+	if req.Action != elastic.ActionDelete || !rule.isMerged() {
+		return
+	}
+
+	fields, shared := r.ruleFields(rule)
+	req.Action = elastic.ActionUpdate
+	req.Script = map[string]interface{}{
+		"source": mergeScript,
+		"lang":   "painless",
+		"params": map[string]interface{}{
+			"fields": fields,
+			"shared": shared,
+		},
+	}
+	req.ScriptedUpsert = true
+}
+
+// ruleFields returns the ES fields which only the rule writes, and the fields also written by other
+// merged rules of the index, e.g, the join column of the doc id, which are kept. It runs in the canal goroutine.
+func (r *River) ruleFields(rule *Rule) ([]string, []string) {
+	others := make(map[string]struct{})
+	for _, other := range r.rules {
+		if other == rule || !other.isMerged() || other.Index != rule.Index || other.TableInfo == nil {
+			continue
+		}
+		for _, field := range r.writtenFields(other) {
+			others[field] = struct{}{}
+		}
+	}
+
+	var owned []string
+	shared := []string{}
+	for _, field := range r.writtenFields(rule) {
+		if _, ok := others[field]; ok {
+			shared = append(shared, field)
+		} else {
+			owned = append(owned, field)
+		}
+	}
+	return owned, shared
+}
+
+// writtenFields returns the ES fields which the rule writes.
+func (r *River) writtenFields(rule *Rule) []string {
+	plans := r.columnPlan(rule)
+
+	fields := make([]string, 0, len(plans))
+	for i, c := range rule.TableInfo.Columns {
+		plan := plans[i]
+		if !plan.synced {
+			continue
+		}
+		if plan.mapped {
+			fields = append(fields, plan.field)
+		} else {
+			fields = append(fields, c.Name)
+		}
+	}
+
+	for _, l := range rule.Lookups {
+		for _, column := range l.columns {
+			fields = append(fields, l.Field[column])
+		}
+	}
+
+	return fields
+}
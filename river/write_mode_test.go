@@ -0,0 +1,143 @@
+package river
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql-elasticsearch/elastic"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+func TestMergeRequest(t *testing.T) {
+	r := new(River)
+
+	rule := &Rule{Schema: "test", Table: "user_profile", Index: "users", Type: "_doc", WriteMode: writeModeMerge,
+		ID: []string{"user_id"}, FieldMapping: map[string]string{"bio": "about"}}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "user_profile"}
+	rule.TableInfo.AddColumn("user_id", "int(11)", "", "")
+	rule.TableInfo.AddColumn("bio", "varchar(256)", "", "")
+	rule.TableInfo.AddColumn("city", "varchar(256)", "", "")
+	rule.TableInfo.PKColumns = []int{0}
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int64(1), "hi", "paris"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].Action != elastic.ActionUpdate || !reqs[0].DocAsUpsert || reqs[0].ID != "1" {
+		t.Fatalf("Expected the upsert of doc 1, but: was %+v", reqs)
+	}
+
+	// all the fields are written, so the doc is complete if it is created
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int64(1), "hi", "paris"}, {int64(1), "hello", "paris"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{"user_id": int64(1), "about": "hello", "city": "paris"}
+	if len(reqs) != 1 || reqs[0].Action != elastic.ActionUpdate || !reqs[0].DocAsUpsert ||
+		!reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Fatalf("Expected the upsert of %v, but: was %+v", expect, reqs)
+	}
+
+	reqs, err = r.makeDeleteRequest(rule, [][]interface{}{{int64(1), "hello", "paris"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].Action != elastic.ActionUpdate || !reqs[0].ScriptedUpsert || reqs[0].Data != nil {
+		t.Fatalf("Expected the script update of doc 1, but: was %+v", reqs)
+	}
+	fields := reqs[0].Script["params"].(map[string]interface{})["fields"]
+	if expect := []string{"user_id", "about", "city"}; !reflect.DeepEqual(fields, expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, fields)
+	}
+
+	// the fields written by another merged table of the index are kept
+	account := &Rule{Schema: "test", Table: "user_account", Index: "users", Type: "_doc", WriteMode: writeModeMerge,
+		ID: []string{"user_id"}}
+	if err := account.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	account.TableInfo = &schema.Table{Schema: "test", Name: "user_account"}
+	account.TableInfo.AddColumn("user_id", "int(11)", "", "")
+	account.TableInfo.AddColumn("email", "varchar(256)", "", "")
+	account.TableInfo.PKColumns = []int{0}
+	r.rules = map[string]*Rule{ruleKey("test", "user_profile"): rule, ruleKey("test", "user_account"): account}
+
+	reqs, err = r.makeDeleteRequest(rule, [][]interface{}{{int64(1), "hello", "paris"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := reqs[0].Script["params"].(map[string]interface{})
+	if expect := []string{"about", "city"}; !reflect.DeepEqual(params["fields"], expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, params["fields"])
+	}
+	if expect := []string{"user_id"}; !reflect.DeepEqual(params["shared"], expect) {
+		t.Errorf("Expected: %v, but: was %v", expect, params["shared"])
+	}
+	r.rules = nil
+
+	// the fields are moved to the new doc
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int64(1), "hello", "paris"}, {int64(2), "hello", "paris"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 2 || reqs[0].ID != "1" || reqs[0].Script == nil || reqs[1].ID != "2" || !reqs[1].DocAsUpsert {
+		t.Fatalf("Expected the fields moved from doc 1 to 2, but: was %+v", reqs)
+	}
+
+	for _, rule := range []*Rule{
+		{Schema: "test", Table: "t", WriteMode: "replace"},
+		{Schema: "test", Table: "t", WriteMode: writeModeMerge, Pipeline: "p"},
+		{Schema: "test", Table: "t", WriteMode: writeModeMerge, NestedField: "items", NestedParentID: []string{"pid"}},
+	} {
+		if err := rule.prepare(); err == nil {
+			t.Errorf("Expected an error for rule %+v", rule)
+		}
+	}
+}
+
+func TestUpsertRequest(t *testing.T) {
+	r := new(River)
+
+	rule := &Rule{Schema: "test", Table: "users", Index: "users", Type: "_doc", WriteMode: writeModeUpsert}
+	if err := rule.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	rule.TableInfo = &schema.Table{Schema: "test", Name: "users"}
+	rule.TableInfo.AddColumn("id", "int(11)", "", "")
+	rule.TableInfo.AddColumn("name", "varchar(256)", "", "")
+	rule.TableInfo.AddColumn("city", "varchar(256)", "", "")
+	rule.TableInfo.PKColumns = []int{0}
+
+	reqs, err := r.makeInsertRequest(rule, [][]interface{}{{int64(1), "a", "paris"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || reqs[0].Action != elastic.ActionIndex {
+		t.Fatalf("Expected the index of doc 1, but: was %+v", reqs)
+	}
+
+	// the whole after image, not only the changed fields
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int64(1), "a", "paris"}, {int64(1), "b", "paris"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{"id": int64(1), "name": "b", "city": "paris"}
+	if len(reqs) != 1 || reqs[0].Action != elastic.ActionUpdate || !reqs[0].DocAsUpsert ||
+		!reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Fatalf("Expected the upsert of %v, but: was %+v", expect, reqs)
+	}
+
+	rule.WriteMode = writeModeIndex
+	reqs, err = r.makeUpdateRequest(rule, [][]interface{}{{int64(1), "a", "paris"}, {int64(1), "b", "paris"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := map[string]interface{}{"name": "b"}; reqs[0].DocAsUpsert || !reflect.DeepEqual(reqs[0].Data, expect) {
+		t.Fatalf("Expected the update of %v, but: was %+v", expect, reqs)
+	}
+}